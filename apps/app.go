@@ -1,8 +1,67 @@
 package apps
 
+import (
+	"errors"
+	"net/url"
+	"time"
+)
+
 type App interface {
 	Start(string) // start or provide extra data
 	Running() bool
 	Quit()
 	FriendlyName() string // return a human-readable name
+	Status() Status       // return the current state, for display
+}
+
+// A Suspender is an App that can save its session when the server shuts down,
+// and resume it when the server starts again.
+type Suspender interface {
+	Suspend()     // quit, but save the session so it can be resumed
+	Resume() bool // resume a saved session, returns false if there is none
+}
+
+// Status describes the current state of an app, as shown on the home page and
+// returned by the API.
+type Status struct {
+	Name       string   `json:"name"`
+	Running    bool     `json:"running"`
+	Connection string   `json:"connection,omitempty"` // connection to the service behind the app
+	Remotes    []Remote `json:"remotes"`
+	Player     *Player  `json:"player,omitempty"` // only while something is playing
+}
+
+// Player describes the media player of a running app.
+type Player struct {
+	Rate         float64       `json:"rate"`   // playback speed, 1 is normal
+	Repeat       string        `json:"repeat"` // "off", "one" or "all"
+	Shuffle      bool          `json:"shuffle"`
+	AudioStreams []AudioStream `json:"audioStreams"`
+	AudioStream  int           `json:"audioStream"` // index of the current stream, -1 if unknown
 }
+
+// AudioStream is an audio track of the video that is playing.
+type AudioStream struct {
+	Index    int    `json:"index"`
+	Language string `json:"language"`
+	Name     string `json:"name"`
+}
+
+// Remote is a device (phone, tablet, browser) that is connected to an app to
+// control it.
+type Remote struct {
+	Id          string    `json:"id"`
+	Name        string    `json:"name"`
+	User        string    `json:"user"`
+	DeviceType  string    `json:"deviceType"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	Access      string    `json:"access,omitempty"` // "allowed", "pending" or "denied"
+}
+
+// A Controller is an App that can be controlled via the API.
+type Controller interface {
+	Control(command string, args url.Values) error
+}
+
+// ErrUnknownCommand is returned by Control for commands the app doesn't know.
+var ErrUnknownCommand = errors.New("unknown command")
@@ -0,0 +1,162 @@
+package youtube
+
+import (
+	"github.com/sargo/kodicast/apps"
+	"github.com/sargo/kodicast/config"
+)
+
+// # Access control
+//
+// Remotes can be allowed or denied by user name or by device ID, with these
+// config keys (all lists of strings):
+//     apps.youtube.access.allow.users
+//     apps.youtube.access.allow.devices
+//     apps.youtube.access.deny.users
+//     apps.youtube.access.deny.devices
+// A remote on a deny list is always denied. When there are allow lists, only
+// remotes on them are allowed. Other remotes are unknown: they are allowed,
+// unless "apps.youtube.access.approval" is true. In that case they have to be
+// approved first, via the home page or the API, with the approval code that is
+// shown on the screen when the remote connects. So only people who can see the
+// TV can approve remotes.
+//
+// The lounge doesn't tell which remote sent a command. While a denied remote
+// is connected, no remote can control playback: the command may have been sent
+// by the denied remote. Unapproved remotes don't lock out allowed remotes, as
+// anyone could connect one: while an allowed remote is connected, unapproved
+// remotes can send every command. Only when no allowed remote is connected,
+// commands that need approval are dropped.
+
+type Access int
+
+const (
+	ACCESS_ALLOWED Access = iota
+	ACCESS_PENDING        // waiting for approval
+	ACCESS_DENIED
+)
+
+func (a Access) String() string {
+	switch a {
+	case ACCESS_ALLOWED:
+		return "allowed"
+	case ACCESS_PENDING:
+		return "pending"
+	case ACCESS_DENIED:
+		return "denied"
+	default:
+		return "unknown"
+	}
+}
+
+// accessPolicy is the access configuration, read once at the start of a run.
+type accessPolicy struct {
+	allowUsers   map[string]bool
+	allowDevices map[string]bool
+	denyUsers    map[string]bool
+	denyDevices  map[string]bool
+	approval     bool // unknown remotes must be approved
+}
+
+// loadAccessPolicy reads the access configuration.
+func loadAccessPolicy() accessPolicy {
+	c := config.Get()
+	policy := accessPolicy{
+		allowUsers:   loadAccessList(c, "apps.youtube.access.allow.users"),
+		allowDevices: loadAccessList(c, "apps.youtube.access.allow.devices"),
+		denyUsers:    loadAccessList(c, "apps.youtube.access.deny.users"),
+		denyDevices:  loadAccessList(c, "apps.youtube.access.deny.devices"),
+	}
+
+	approval, err := c.GetBool("apps.youtube.access.approval", func() (bool, error) {
+		return false, nil
+	})
+	if err != nil {
+		// Be safe when the config is broken.
+		logger.Warnln("could not read approval setting:", err)
+		approval = true
+	}
+	policy.approval = approval
+
+	return policy
+}
+
+func loadAccessList(c *config.Config, key string) map[string]bool {
+	var values []string
+	if _, err := c.GetValue(key, &values); err != nil {
+		logger.Warnln("could not read access list:", err)
+	}
+	list := make(map[string]bool, len(values))
+	for _, value := range values {
+		list[value] = true
+	}
+	return list
+}
+
+// check returns the access a newly connected remote gets.
+func (p accessPolicy) check(remote apps.Remote) Access {
+	if p.denyUsers[remote.User] || p.denyDevices[remote.Id] {
+		return ACCESS_DENIED
+	}
+	if p.allowUsers[remote.User] || p.allowDevices[remote.Id] {
+		return ACCESS_ALLOWED
+	}
+	if p.approval {
+		return ACCESS_PENDING
+	}
+	if len(p.allowUsers) > 0 || len(p.allowDevices) > 0 {
+		return ACCESS_DENIED
+	}
+	return ACCESS_ALLOWED
+}
+
+// isControlCommand returns true for commands that change what's playing or
+// what's on the screen.
+// Commands that only request information are always allowed.
+func isControlCommand(command interface{}) bool {
+	switch command.(type) {
+	case setPlaylist, updatePlaylist, setVideo, setVolume, pause, play, seekTo, stopVideo, next, previous, setAutoplayMode, setSubtitlesTrack, dpadCommand, setPlaybackSpeed, setPlaylistMode:
+		return true
+	default:
+		return false
+	}
+}
+
+// needsApproval returns true for commands that unapproved remotes may not
+// send. Keys are included, as they control all of Kodi, not only the video.
+func needsApproval(command interface{}) bool {
+	switch command.(type) {
+	case setPlaylist, setVideo, setVolume, dpadCommand:
+		return true
+	default:
+		return false
+	}
+}
+
+// permits returns whether a command may be executed with the currently
+// connected remotes. If not, it also returns a remote that blocks it.
+func (rl *remoteList) permits(command interface{}) (apps.Remote, bool) {
+	if !isControlCommand(command) {
+		return apps.Remote{}, true
+	}
+
+	remotes := rl.list()
+	for _, remote := range remotes {
+		if remote.Access == ACCESS_DENIED.String() {
+			return remote, false
+		}
+	}
+	for _, remote := range remotes {
+		if remote.Access == ACCESS_ALLOWED.String() {
+			// The command may have been sent by this remote.
+			return apps.Remote{}, true
+		}
+	}
+	if needsApproval(command) {
+		for _, remote := range remotes {
+			if remote.Access == ACCESS_PENDING.String() {
+				return remote, false
+			}
+		}
+	}
+	return apps.Remote{}, true
+}
@@ -0,0 +1,109 @@
+package youtube
+
+import (
+	"testing"
+
+	"github.com/sargo/kodicast/apps/youtube/mp"
+)
+
+func newTestRemoteList() *remoteList {
+	return &remoteList{policy: accessPolicy{
+		allowUsers: map[string]bool{"Alice": true},
+		denyUsers:  map[string]bool{"Mallory": true},
+		approval:   true,
+	}}
+}
+
+func TestPermits(t *testing.T) {
+	rl := newTestRemoteList()
+	rl.connect(remoteConnected{Id: "guest", Name: "Guest"})
+	if _, ok := rl.permits(pause{}); !ok {
+		t.Error("pending remote may not pause")
+	}
+	if remote, ok := rl.permits(setVideo{}); ok || remote.Id != "guest" {
+		t.Error("pending remote may set a video")
+	}
+	if remote, ok := rl.permits(dpadCommand{mp.KEY_HOME}); ok || remote.Id != "guest" {
+		t.Error("pending remote may press keys")
+	}
+
+	// An unapproved remote doesn't lock out allowed remotes, a denied one
+	// does.
+	rl.connect(remoteConnected{Id: "alice", Name: "Phone", User: "Alice"})
+	if _, ok := rl.permits(setVideo{}); !ok {
+		t.Error("unapproved remote blocks commands while an allowed remote is connected")
+	}
+	rl.connect(remoteConnected{Id: "mallory", Name: "Phone", User: "Mallory"})
+	for _, command := range []interface{}{setVideo{}, pause{}, seekTo{}} {
+		if remote, ok := rl.permits(command); ok || remote.Id != "mallory" {
+			t.Errorf("%T permitted while a denied remote is connected", command)
+		}
+	}
+	if _, ok := rl.permits(getVolume{}); !ok {
+		t.Error("requests for information are blocked")
+	}
+
+	rl.disconnect("mallory")
+	if _, ok := rl.permits(pause{}); !ok {
+		t.Error("commands are blocked after the denied remote has left")
+	}
+}
+
+func TestApprovalCode(t *testing.T) {
+	rl := newTestRemoteList()
+	pending := rl.reset([]remoteConnected{
+		{Id: "guest", Name: "Guest", Type: "REMOTE_CONTROL"},
+		{Id: "alice", Name: "Phone", User: "Alice", Type: "REMOTE_CONTROL"},
+		{Id: "screen", Type: "LOUNGE_SCREEN"},
+	})
+	if len(pending) != 1 || pending[0].Id != "guest" {
+		t.Fatalf("got pending remotes %v", pending)
+	}
+	code := rl.code("guest")
+	if len(code) != 6 {
+		t.Fatalf("got approval code %q", code)
+	}
+	if rl.reset([]remoteConnected{
+		{Id: "guest", Name: "Guest", Type: "REMOTE_CONTROL"},
+		{Id: "alice", Name: "Phone", User: "Alice", Type: "REMOTE_CONTROL"},
+	}) != nil {
+		t.Error("known remote is reported again")
+	}
+
+	if _, err := rl.setAccess("guest", ACCESS_ALLOWED, ""); err != errWrongCode {
+		t.Errorf("approved without code: %v", err)
+	}
+	if _, err := rl.setAccess("alice", ACCESS_DENIED, code); err != errNotPending {
+		t.Errorf("denied allowed remote: %v", err)
+	}
+	if _, err := rl.setAccess("guest", ACCESS_ALLOWED, code); err != nil {
+		t.Fatal(err)
+	}
+	if access := rl.access("guest"); access != ACCESS_ALLOWED {
+		t.Errorf("remote is %s after approving", access)
+	}
+	if _, err := rl.setAccess("guest", ACCESS_DENIED, code); err == nil {
+		t.Error("approval code can be used twice")
+	}
+}
+
+func TestApprovalAttempts(t *testing.T) {
+	rl := newTestRemoteList()
+	rl.connect(remoteConnected{Id: "guest", Name: "Guest"})
+	code := rl.code("guest")
+	for i := 0; i < MAX_APPROVAL_ATTEMPTS; i++ {
+		if _, err := rl.setAccess("guest", ACCESS_ALLOWED, "wrong"); err != errWrongCode {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+	}
+	if _, err := rl.setAccess("guest", ACCESS_ALLOWED, code); err != errApprovalBlocked {
+		t.Errorf("approved after too many attempts: %v", err)
+	}
+
+	// Connecting again gives a new code.
+	rl.disconnect("guest")
+	rl.connect(remoteConnected{Id: "guest", Name: "Guest"})
+	if _, err := rl.setAccess("guest", ACCESS_ALLOWED, rl.code("guest")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,58 @@
+package youtube
+
+import (
+	"github.com/sargo/kodicast/apps/youtube/mp"
+	"github.com/sargo/kodicast/config"
+)
+
+// # Autoplay
+//
+// Autoplay continues playback when the queue runs out. The next video is
+// chosen by a provider configured with one of these keys:
+//     apps.youtube.autoplay.list     a list of video IDs, played in order
+//     apps.youtube.autoplay.command  a command (list of arguments) that gets
+//                                    the current video ID as last argument and
+//                                    prints the next video ID
+// Without a provider, autoplay is reported as unsupported to remotes. Whether
+// autoplay is enabled is remembered in "apps.youtube.autoplay".
+
+const AUTOPLAY_CONFIG_KEY = "apps.youtube.autoplay"
+
+// loadAutoplay returns the configured next video provider (or nil) and
+// whether autoplay is enabled.
+func loadAutoplay() (mp.NextVideoProvider, bool) {
+	c := config.Get()
+
+	var provider mp.NextVideoProvider
+	var command []string
+	var list []string
+	if ok, err := c.GetValue(AUTOPLAY_CONFIG_KEY+".command", &command); err != nil {
+		logger.Warnln("could not read autoplay command:", err)
+	} else if ok && len(command) > 0 {
+		provider = mp.NewCommandProvider(command)
+	}
+	if provider == nil {
+		if ok, err := c.GetValue(AUTOPLAY_CONFIG_KEY+".list", &list); err != nil {
+			logger.Warnln("could not read autoplay list:", err)
+		} else if ok && len(list) > 0 {
+			provider = mp.NewListProvider(list)
+		}
+	}
+
+	enabled, err := c.GetBool(AUTOPLAY_CONFIG_KEY, func() (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		logger.Warnln("could not read autoplay setting:", err)
+	}
+
+	return provider, enabled
+}
+
+// setAutoplay enables or disables autoplay, and remembers it for the next run.
+func (s *session) setAutoplay(enabled bool) {
+	s.mp.SetAutoplay(enabled)
+	if err := config.Get().SetValue(AUTOPLAY_CONFIG_KEY, enabled); err != nil {
+		logger.Warnln("could not save autoplay setting:", err)
+	}
+}
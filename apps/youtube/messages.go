@@ -0,0 +1,582 @@
+package youtube
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sargo/kodicast/apps/youtube/mp"
+)
+
+// # Message format
+//
+// Messages from YouTube arrive in chunks over a long-running HTTP response.
+// Each chunk starts with a line containing the decimal length of the chunk in
+// bytes, followed by a JSON array of messages. A message looks like this:
+//     [index, [command, args...]]
+// Everything coming in over the network is validated here, so a malformed
+// chunk results in an error instead of a crash.
+
+// Maximum size of a single chunk. Normal chunks are at most a few kilobytes.
+const MAX_CHUNK_SIZE = 1024 * 1024
+
+var errChunkLength = errors.New("invalid chunk length")
+
+// readChunk reads a single length-prefixed chunk from the message stream.
+// It returns io.EOF when the stream has terminated cleanly between chunks.
+func readChunk(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		if line == "" && err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	length, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || length < 0 || length > MAX_CHUNK_SIZE {
+		return nil, fmt.Errorf("%s: %#v", errChunkLength, line)
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(reader, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// rawMessage is a single message as received from the message channel, with
+// the index and command validated but the arguments not yet decoded.
+type rawMessage struct {
+	index   int
+	command string
+	args    []interface{}
+}
+
+// decodeChunk splits a chunk into the separate messages it contains.
+func decodeChunk(data []byte) ([]json.RawMessage, error) {
+	var messages []json.RawMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, fmt.Errorf("could not decode chunk: %s", err)
+	}
+	return messages, nil
+}
+
+// decodeMessage validates a single message from a chunk.
+func decodeMessage(data json.RawMessage) (rawMessage, error) {
+	message := rawMessage{}
+
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil || len(fields) != 2 {
+		return message, fmt.Errorf("message is not an [index, body] pair: %s", data)
+	}
+
+	var index float64
+	if err := json.Unmarshal(fields[0], &index); err != nil || index < 0 || index != float64(int32(index)) {
+		return message, fmt.Errorf("message has an invalid index: %s", data)
+	}
+	message.index = int(index)
+
+	var body []interface{}
+	if err := json.Unmarshal(fields[1], &body); err != nil || len(body) == 0 {
+		return message, fmt.Errorf("message %d has no command", message.index)
+	}
+	command, ok := body[0].(string)
+	if !ok || command == "" {
+		return message, fmt.Errorf("message %d has an invalid command", message.index)
+	}
+	message.command = command
+	message.args = body[1:]
+
+	return message, nil
+}
+
+// decodeArgs converts the arguments of a command into a string map. Most
+// commands carry a single object with string values, but numbers and booleans
+// are converted to their string form instead of being dropped.
+func decodeArgs(message rawMessage) (map[string]string, error) {
+	args := make(map[string]string)
+	if len(message.args) == 0 {
+		return args, nil
+	}
+
+	argsMap, ok := message.args[0].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("arguments of %s are not an object", message.command)
+	}
+	for k, v := range argsMap {
+		switch v := v.(type) {
+		case string:
+			args[k] = v
+		case float64:
+			args[k] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			args[k] = strconv.FormatBool(v)
+		case nil:
+			args[k] = ""
+		default:
+			// Nested objects are sent as JSON strings by YouTube, so this
+			// should not happen. Keep the JSON form anyway.
+			buf, err := json.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("argument %s of %s: %s", k, message.command, err)
+			}
+			args[k] = string(buf)
+		}
+	}
+	return args, nil
+}
+
+// parseTime parses a time in (fractional) seconds as sent by YouTube.
+func parseTime(s string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if seconds < 0 || seconds > float64(1<<31) {
+		return 0, fmt.Errorf("time out of range: %s", s)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// formatTime formats a time as (fractional) seconds for YouTube.
+func formatTime(t time.Duration) string {
+	return strconv.FormatFloat(t.Seconds(), 'f', 3, 64)
+}
+
+// Incoming commands, as received from remotes via the lounge.
+
+// remoteConnected is also used for the devices in loungeStatus.
+type remoteConnected struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	User       string `json:"user"`
+	App        string `json:"app"`
+	ClientName string `json:"clientName"`
+	Type       string `json:"type"`
+}
+
+type remoteDisconnected struct {
+	Id   string
+	Name string
+	User string
+}
+
+type loungeStatus struct {
+	Devices []remoteConnected
+}
+
+type getVolume struct{}
+
+type setVolume struct {
+	Volume    int
+	Delta     int
+	Muted     bool
+	HasVolume bool
+	HasDelta  bool
+	HasMuted  bool
+}
+
+type getPlaylist struct{}
+
+type setPlaylist struct {
+	VideoIds     []string
+	CurrentIndex int
+	CurrentTime  time.Duration
+	ListId       string
+}
+
+type updatePlaylist struct {
+	VideoIds []string
+	ListId   string
+}
+
+type setVideo struct {
+	VideoId     string
+	CurrentTime time.Duration
+}
+
+type getNowPlaying struct{}
+
+type getSubtitlesTrack struct{}
+
+type pause struct{}
+
+type play struct{}
+
+type seekTo struct {
+	NewTime time.Duration
+}
+
+type stopVideo struct{}
+
+type next struct{}
+
+type previous struct{}
+
+type setSubtitlesTrack struct {
+	VideoId      string
+	LanguageCode string // empty to turn subtitles off
+}
+
+// setPlaylistMode only knows about repeating the whole queue ("loop").
+type setPlaylistMode struct {
+	Loop    bool
+	Shuffle bool
+}
+
+type setPlaybackSpeed struct {
+	Rate float64
+}
+
+type dpadCommand struct {
+	Key mp.Key
+}
+
+type setAutoplayMode struct {
+	Enabled bool
+}
+
+var errUnknownCommand = errors.New("unknown command")
+
+// decodeCommand converts an incoming message into one of the command types
+// above, validating all arguments.
+func decodeCommand(message incomingMessage) (interface{}, error) {
+	args := message.args
+	switch message.command {
+	case "remoteConnected":
+		if args["id"] == "" {
+			return nil, errors.New("remote without id")
+		}
+		return remoteConnected{args["id"], args["name"], args["user"], args["app"], args["clientName"], args["type"]}, nil
+	case "remoteDisconnected":
+		return remoteDisconnected{args["id"], args["name"], args["user"]}, nil
+	case "loungeStatus":
+		// The devices are sent as a JSON string.
+		var devices []remoteConnected
+		if args["devices"] != "" {
+			if err := json.Unmarshal([]byte(args["devices"]), &devices); err != nil {
+				return nil, fmt.Errorf("could not decode devices: %s", err)
+			}
+		}
+		return loungeStatus{devices}, nil
+	case "getVolume":
+		return getVolume{}, nil
+	case "setVolume":
+		command := setVolume{}
+		if muted, ok := args["muted"]; ok {
+			m, err := strconv.ParseBool(muted)
+			if err != nil {
+				return nil, fmt.Errorf("muted could not be parsed: %#v", muted)
+			}
+			command.Muted = m
+			command.HasMuted = true
+		}
+		if delta, ok := args["delta"]; ok {
+			d, err := strconv.Atoi(delta)
+			if err != nil {
+				return nil, fmt.Errorf("volume delta could not be parsed: %s", err)
+			}
+			command.Delta = d
+			command.HasDelta = true
+		} else if _, ok := args["volume"]; ok || !command.HasMuted {
+			volume, err := strconv.Atoi(args["volume"])
+			if err != nil || volume < 0 || volume > 100 {
+				return nil, fmt.Errorf("volume could not be parsed: %#v", args["volume"])
+			}
+			command.Volume = volume
+			command.HasVolume = true
+		}
+		return command, nil
+	case "getPlaylist":
+		return getPlaylist{}, nil
+	case "setPlaylist":
+		playlist := splitVideoIds(args["videoIds"])
+		index, err := strconv.Atoi(args["currentIndex"])
+		if err != nil {
+			return nil, fmt.Errorf("currentIndex could not be parsed: %s", err)
+		}
+		position, err := parseTime(args["currentTime"])
+		if err != nil {
+			return nil, fmt.Errorf("currentTime could not be parsed: %s", err)
+		}
+		if index < 0 || len(playlist) == 0 || index >= len(playlist) {
+			return nil, errors.New("setPlaylist got invalid parameters")
+		}
+		return setPlaylist{playlist, index, position, args["listId"]}, nil
+	case "updatePlaylist":
+		return updatePlaylist{splitVideoIds(args["videoIds"]), args["listId"]}, nil
+	case "setVideo":
+		if args["videoId"] == "" {
+			return nil, errors.New("setVideo without videoId")
+		}
+		position, err := parseTime(args["currentTime"])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse currentTime: %s", err)
+		}
+		return setVideo{args["videoId"], position}, nil
+	case "getNowPlaying":
+		return getNowPlaying{}, nil
+	case "getSubtitlesTrack":
+		return getSubtitlesTrack{}, nil
+	case "pause":
+		return pause{}, nil
+	case "play":
+		return play{}, nil
+	case "seekTo":
+		position, err := parseTime(args["newTime"])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse newTime for seekTo: %s", err)
+		}
+		return seekTo{position}, nil
+	case "stopVideo":
+		return stopVideo{}, nil
+	case "next":
+		return next{}, nil
+	case "previous":
+		return previous{}, nil
+	case "setSubtitlesTrack":
+		language := args["languageCode"]
+		if language == "" && args["vssId"] != "" {
+			// The vssId looks like ".en" or "a.en" (automatic captions).
+			vssId := args["vssId"]
+			language = vssId[strings.IndexByte(vssId, '.')+1:]
+		}
+		return setSubtitlesTrack{args["videoId"], language}, nil
+	case "setPlaylistMode":
+		loop, err := strconv.ParseBool(args["loopEnabled"])
+		if err != nil {
+			return nil, fmt.Errorf("loopEnabled could not be parsed: %#v", args["loopEnabled"])
+		}
+		shuffle, err := strconv.ParseBool(args["shuffleEnabled"])
+		if err != nil {
+			return nil, fmt.Errorf("shuffleEnabled could not be parsed: %#v", args["shuffleEnabled"])
+		}
+		return setPlaylistMode{loop, shuffle}, nil
+	case "setPlaybackSpeed":
+		rate, err := strconv.ParseFloat(args["playbackSpeed"], 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("playbackSpeed could not be parsed: %#v", args["playbackSpeed"])
+		}
+		return setPlaybackSpeed{rate}, nil
+	case "dpadCommand":
+		key := args["key"]
+		if key == "" {
+			key = args["keyCode"]
+		}
+		if key == "" {
+			return nil, errors.New("dpadCommand without key")
+		}
+		return dpadCommand{mp.ParseKey(key)}, nil
+	case "setAutoplayMode":
+		switch args["autoplayMode"] {
+		case "ENABLED":
+			return setAutoplayMode{true}, nil
+		case "DISABLED":
+			return setAutoplayMode{false}, nil
+		default:
+			return nil, fmt.Errorf("unknown autoplay mode: %#v", args["autoplayMode"])
+		}
+	default:
+		return nil, errUnknownCommand
+	}
+}
+
+// splitVideoIds splits a comma-separated list of video IDs, ignoring empty
+// entries.
+func splitVideoIds(s string) []string {
+	videoIds := make([]string, 0, strings.Count(s, ",")+1)
+	for _, videoId := range strings.Split(s, ",") {
+		if videoId != "" {
+			videoIds = append(videoIds, videoId)
+		}
+	}
+	return videoIds
+}
+
+// Outgoing commands, to be sent to remotes via the lounge.
+
+// outgoingCommand is implemented by all outgoing command types.
+type outgoingCommand interface {
+	message() outgoingMessage
+}
+
+type onStateChange struct {
+	CurrentTime time.Duration
+	State       mp.State
+	Duration    time.Duration // 0 when unknown
+	Live        bool
+}
+
+func (c onStateChange) message() outgoingMessage {
+	message := outgoingMessage{"onStateChange", map[string]string{
+		"currentTime": formatTime(c.CurrentTime),
+		"state":       strconv.Itoa(int(c.State)),
+	}}
+	addDuration(message.args, c.Duration, c.Live)
+	return message
+}
+
+// addDuration adds the duration of the current video to the arguments of a
+// message, if it is known. For live videos, the duration is the seekable range
+// and the current time is relative to its start.
+func addDuration(args map[string]string, duration time.Duration, live bool) {
+	if live {
+		args["isLive"] = "true"
+	}
+	if duration <= 0 {
+		return
+	}
+	args["duration"] = formatTime(duration)
+	if live {
+		args["seekableStartTime"] = formatTime(0)
+		args["seekableEndTime"] = formatTime(duration)
+	}
+}
+
+type onVolumeChanged struct {
+	Volume int
+	Muted  bool
+}
+
+func (c onVolumeChanged) message() outgoingMessage {
+	return outgoingMessage{"onVolumeChanged", map[string]string{
+		"volume": strconv.Itoa(c.Volume),
+		"muted":  strconv.FormatBool(c.Muted),
+	}}
+}
+
+type nowPlayingPlaylist struct {
+	mp.PlaylistState
+}
+
+func (c nowPlayingPlaylist) message() outgoingMessage {
+	message := outgoingMessage{"nowPlayingPlaylist", map[string]string{}}
+	if len(c.Playlist) > 0 {
+		message.args["videoIds"] = strings.Join(c.Playlist, ",")
+		message.args["videoId"] = c.Playlist[c.Index]
+		message.args["currentTime"] = formatTime(c.Position)
+		message.args["state"] = strconv.Itoa(int(c.State))
+		message.args["currentIndex"] = strconv.Itoa(c.Index)
+		//message.args["listId"] = ""
+		addDuration(message.args, c.Duration, c.Live)
+	}
+	return message
+}
+
+type nowPlaying struct {
+	mp.PlaylistState
+}
+
+func (c nowPlaying) message() outgoingMessage {
+	message := outgoingMessage{"nowPlaying", map[string]string{}}
+	if len(c.Playlist) > 0 {
+		message.args["videoId"] = c.Playlist[c.Index]
+		message.args["currentTime"] = formatTime(c.Position)
+		message.args["state"] = strconv.Itoa(int(c.State))
+		message.args["currentIndex"] = strconv.Itoa(c.Index)
+		message.args["listId"] = c.ListId
+		addDuration(message.args, c.Duration, c.Live)
+	}
+	return message
+}
+
+type confirmPlaylistUpdate struct {
+	Updated bool
+}
+
+func (c confirmPlaylistUpdate) message() outgoingMessage {
+	return outgoingMessage{"confirmPlaylistUpdate", map[string]string{
+		"updated": strconv.FormatBool(c.Updated),
+	}}
+}
+
+type onSubtitlesTrackChanged struct {
+	VideoId      string
+	LanguageCode string // empty when subtitles are off
+	LanguageName string
+}
+
+func (c onSubtitlesTrackChanged) message() outgoingMessage {
+	message := outgoingMessage{"onSubtitlesTrackChanged", map[string]string{
+		"videoId": c.VideoId,
+	}}
+	if c.LanguageCode != "" {
+		message.args["languageCode"] = c.LanguageCode
+		message.args["languageName"] = c.LanguageName
+	}
+	return message
+}
+
+type onAutoplayModeChanged struct {
+	Supported bool
+	Enabled   bool
+}
+
+func (c onAutoplayModeChanged) message() outgoingMessage {
+	mode := "UNSUPPORTED"
+	if c.Supported {
+		mode = "DISABLED"
+		if c.Enabled {
+			mode = "ENABLED"
+		}
+	}
+	return outgoingMessage{"onAutoplayModeChanged", map[string]string{
+		"autoplayMode": mode,
+	}}
+}
+
+type autoplayUpNext struct {
+	VideoId string
+}
+
+func (c autoplayUpNext) message() outgoingMessage {
+	return outgoingMessage{"autoplayUpNext", map[string]string{
+		"videoId": c.VideoId,
+	}}
+}
+
+type onHasPreviousNextChanged struct {
+	HasPrevious bool
+	HasNext     bool
+}
+
+func (c onHasPreviousNextChanged) message() outgoingMessage {
+	return outgoingMessage{"onHasPreviousNextChanged", map[string]string{
+		"hasPrevious": strconv.FormatBool(c.HasPrevious),
+		"hasNext":     strconv.FormatBool(c.HasNext),
+	}}
+}
+
+type onPlaybackSpeedChanged struct {
+	Rate float64
+}
+
+func (c onPlaybackSpeedChanged) message() outgoingMessage {
+	return outgoingMessage{"onPlaybackSpeedChanged", map[string]string{
+		"playbackSpeed": strconv.FormatFloat(c.Rate, 'f', -1, 64),
+	}}
+}
+
+type onPlaylistModeChanged struct {
+	Repeat  mp.RepeatMode
+	Shuffle bool
+}
+
+func (c onPlaylistModeChanged) message() outgoingMessage {
+	// Remotes can't show repeat-one, so it is shown as a loop.
+	return outgoingMessage{"onPlaylistModeChanged", map[string]string{
+		"loopEnabled":    strconv.FormatBool(c.Repeat != mp.REPEAT_OFF),
+		"shuffleEnabled": strconv.FormatBool(c.Shuffle),
+	}}
+}
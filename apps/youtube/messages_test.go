@@ -0,0 +1,271 @@
+package youtube
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sargo/kodicast/apps/youtube/mp"
+)
+
+// Chunks as sent by the lounge server (session IDs shortened).
+var loungeChunks = []string{
+	`[[0,["c","5D8C0B0E1F2A3B4C","",8]
+]
+,[1,["S","GRtJ2a8UcdlAmD3kQq"]]]
+`,
+	`[[2,["loungeStatus",{"devices":"[{\"app\":\"android-phone-13.43.54\",\"capabilities\":\"que,dsdtr,atp\",\"clientName\":\"android\",\"experiments\":\"\",\"name\":\"Pixel 3a\",\"id\":\"a1b2c3d4-e5f6\",\"type\":\"REMOTE_CONTROL\",\"hasCc\":\"true\",\"user\":\"Alice\",\"userAvatarUri\":\"\"}]","connectionEventDetails":"{\"deviceName\":\"Pixel 3a\"}"}]]]
+`,
+	`[[3,["setPlaylist",{"videoId":"dQw4w9WgXcQ","currentTime":"12.5","currentIndex":"1","videoIds":"jNQXAC9IVRw,dQw4w9WgXcQ","listId":"RQabc","ctt":"x"}]]]
+`,
+	`[[4,["noop"]]]
+`,
+}
+
+func chunk(data string) string {
+	return strconv.Itoa(len(data)) + "\n" + data
+}
+
+func TestReadChunk(t *testing.T) {
+	stream := ""
+	for _, data := range loungeChunks {
+		stream += chunk(data)
+	}
+	reader := bufio.NewReader(strings.NewReader(stream))
+	for i, want := range loungeChunks {
+		data, err := readChunk(reader)
+		if err != nil {
+			t.Fatalf("chunk %d: %s", i, err)
+		}
+		if string(data) != want {
+			t.Errorf("chunk %d: got %q, want %q", i, data, want)
+		}
+	}
+	if _, err := readChunk(reader); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of the stream, got %v", err)
+	}
+
+	for _, stream := range []string{
+		"abc\n[]",              // non-numeric header
+		"-5\n[]",               // negative length
+		"0x10\n[]",             // not decimal
+		"99999999999\n[]",      // too large
+		"10\n[[0,[",            // truncated data
+		"15\n[[0,[\"noop\"]]]", // truncated by one byte
+	} {
+		reader := bufio.NewReader(strings.NewReader(stream))
+		if data, err := readChunk(reader); err == nil || err == io.EOF {
+			t.Errorf("%q: expected an error, got %q, %v", stream, data, err)
+		}
+	}
+}
+
+// TestReadChunkPrefixes reads every prefix of the stream and some malformed
+// streams: reading must end with an error, and never return an oversized chunk.
+func TestReadChunkPrefixes(t *testing.T) {
+	var streams [][]byte
+	for _, data := range loungeChunks {
+		for i := 0; i <= len(chunk(data)); i++ {
+			streams = append(streams, []byte(chunk(data)[:i]))
+		}
+	}
+	for _, stream := range []string{"abc\n[]", "-1\n", "1048577\n", "3\n[]", "\n\n"} {
+		streams = append(streams, []byte(stream))
+	}
+
+	for _, stream := range streams {
+		reader := bufio.NewReader(bytes.NewReader(stream))
+		for n := 0; ; n++ {
+			data, err := readChunk(reader)
+			if err != nil {
+				break
+			}
+			if len(data) > MAX_CHUNK_SIZE || n > len(stream) {
+				t.Fatalf("%q: invalid chunk of %d bytes", stream, len(data))
+			}
+		}
+	}
+}
+
+// TestDecodeMalformed decodes every prefix of the chunks and some malformed
+// messages: invalid messages must be rejected instead of accepted or panicking.
+func TestDecodeMalformed(t *testing.T) {
+	var chunks []string
+	for _, data := range loungeChunks {
+		for i := 0; i <= len(data); i++ {
+			chunks = append(chunks, data[:i])
+		}
+	}
+	chunks = append(chunks,
+		`[[-1,["noop"]]]`,
+		`[[1.5,["noop"]]]`,
+		`[[1,[]]]`,
+		`[[1,[5]]]`,
+		`[[1,["setVolume",[1,2]]]]`,
+		`[[1,["setVolume",{"volume":{"a":1}}]]]`,
+	)
+
+	for _, data := range chunks {
+		messages, err := decodeChunk([]byte(data))
+		if err != nil {
+			continue
+		}
+		for _, data := range messages {
+			message, err := decodeMessage(data)
+			if err != nil {
+				continue
+			}
+			if message.index < 0 || message.command == "" {
+				t.Fatalf("invalid message accepted: %s", data)
+			}
+			args, err := decodeArgs(message)
+			if err != nil {
+				continue
+			}
+			decodeCommand(incomingMessage{message.index, message.command, args})
+		}
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	messages, err := decodeChunk([]byte(loungeChunks[2]))
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("could not decode chunk: %v", err)
+	}
+	message, err := decodeMessage(messages[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.index != 3 || message.command != "setPlaylist" {
+		t.Errorf("got message %d %s", message.index, message.command)
+	}
+	args, err := decodeArgs(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args["currentIndex"] != "1" || args["videoId"] != "dQw4w9WgXcQ" {
+		t.Errorf("got args %v", args)
+	}
+
+	for _, data := range []string{
+		`5`,
+		`[1]`,
+		`[1,["noop"],3]`,
+		`[-1,["noop"]]`,
+		`[1.5,["noop"]]`,
+		`["1",["noop"]]`,
+		`[1,[]]`,
+		`[1,[""]]`,
+		`[1,[5]]`,
+		`[1,"noop"]`,
+	} {
+		if _, err := decodeMessage([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error", data)
+		}
+	}
+}
+
+func TestDecodeCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		args    map[string]string
+		want    interface{} // nil when an error is expected
+	}{
+		{"remoteConnected", map[string]string{"id": "a1", "name": "Pixel", "user": "Alice"}, remoteConnected{Id: "a1", Name: "Pixel", User: "Alice"}},
+		{"remoteConnected", map[string]string{"name": "Pixel"}, nil},
+		{"remoteDisconnected", map[string]string{"id": "a1"}, remoteDisconnected{Id: "a1"}},
+		{"loungeStatus", map[string]string{}, loungeStatus{}},
+		{"loungeStatus", map[string]string{"devices": `[{"id":"a1","name":"Pixel"}]`}, loungeStatus{[]remoteConnected{{Id: "a1", Name: "Pixel"}}}},
+		{"loungeStatus", map[string]string{"devices": `[{`}, nil},
+		{"getVolume", nil, getVolume{}},
+		{"setVolume", map[string]string{"volume": "40"}, setVolume{Volume: 40, HasVolume: true}},
+		{"setVolume", map[string]string{"volume": "101"}, nil},
+		{"setVolume", map[string]string{"volume": "loud"}, nil},
+		{"setVolume", map[string]string{"delta": "-5"}, setVolume{Delta: -5, HasDelta: true}},
+		{"setVolume", map[string]string{"muted": "true"}, setVolume{Muted: true, HasMuted: true}},
+		{"setVolume", map[string]string{"muted": "yes"}, nil},
+		{"setVolume", map[string]string{}, nil},
+		{"setPlaylist", map[string]string{"videoIds": "a,b,c", "currentIndex": "2", "currentTime": "1.5", "listId": "L"}, setPlaylist{[]string{"a", "b", "c"}, 2, 1500 * time.Millisecond, "L"}},
+		{"setPlaylist", map[string]string{"videoIds": "a,b", "currentIndex": "2", "currentTime": "0"}, nil},
+		{"setPlaylist", map[string]string{"videoIds": "a", "currentIndex": "-1", "currentTime": "0"}, nil},
+		{"setPlaylist", map[string]string{"videoIds": "", "currentIndex": "0", "currentTime": "0"}, nil},
+		{"setPlaylist", map[string]string{"videoIds": "a", "currentIndex": "x", "currentTime": "0"}, nil},
+		{"updatePlaylist", map[string]string{"videoIds": "a,,b"}, updatePlaylist{[]string{"a", "b"}, ""}},
+		{"setVideo", map[string]string{"videoId": "a", "currentTime": "12"}, setVideo{"a", 12 * time.Second}},
+		{"setVideo", map[string]string{"currentTime": "12"}, nil},
+		{"seekTo", map[string]string{"newTime": "61.25"}, seekTo{61250 * time.Millisecond}},
+		{"seekTo", map[string]string{"newTime": "soon"}, nil},
+		{"pause", nil, pause{}},
+		{"play", nil, play{}},
+		{"stopVideo", nil, stopVideo{}},
+		{"next", nil, next{}},
+		{"previous", nil, previous{}},
+		{"setSubtitlesTrack", map[string]string{"videoId": "a", "languageCode": "en"}, setSubtitlesTrack{"a", "en"}},
+		{"setSubtitlesTrack", map[string]string{"videoId": "a", "vssId": "a.nl"}, setSubtitlesTrack{"a", "nl"}},
+		{"setSubtitlesTrack", map[string]string{"videoId": "a"}, setSubtitlesTrack{"a", ""}},
+		{"setPlaylistMode", map[string]string{"loopEnabled": "true", "shuffleEnabled": "false"}, setPlaylistMode{true, false}},
+		{"setPlaylistMode", map[string]string{"loopEnabled": "true"}, nil},
+		{"setPlaybackSpeed", map[string]string{"playbackSpeed": "1.5"}, setPlaybackSpeed{1.5}},
+		{"setPlaybackSpeed", map[string]string{"playbackSpeed": "0"}, nil},
+		{"dpadCommand", map[string]string{"key": "UP"}, dpadCommand{mp.KEY_UP}},
+		{"dpadCommand", map[string]string{"keyCode": "KEYCODE_DPAD_CENTER"}, dpadCommand{mp.KEY_ENTER}},
+		{"dpadCommand", map[string]string{}, nil},
+		{"setAutoplayMode", map[string]string{"autoplayMode": "ENABLED"}, setAutoplayMode{true}},
+		{"setAutoplayMode", map[string]string{"autoplayMode": "MAYBE"}, nil},
+		{"somethingNew", nil, nil},
+	}
+
+	for _, test := range tests {
+		args := test.args
+		if args == nil {
+			args = map[string]string{}
+		}
+		got, err := decodeCommand(incomingMessage{1, test.command, args})
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s %v: expected an error, got %#v", test.command, test.args, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %v: %s", test.command, test.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %v: got %#v, want %#v", test.command, test.args, got, test.want)
+		}
+	}
+
+	if _, err := decodeCommand(incomingMessage{1, "somethingNew", nil}); err != errUnknownCommand {
+		t.Errorf("expected errUnknownCommand, got %v", err)
+	}
+}
+
+func TestOutgoingDuration(t *testing.T) {
+	tests := []struct {
+		command outgoingCommand
+		want    map[string]string // arguments that must be there, "" for absent
+	}{
+		{onStateChange{time.Second, mp.STATE_PLAYING, 0, false}, map[string]string{"duration": "", "seekableEndTime": "", "isLive": ""}},
+		{onStateChange{time.Second, mp.STATE_PLAYING, time.Minute, false}, map[string]string{"duration": "60.000", "seekableStartTime": "", "seekableEndTime": "", "isLive": ""}},
+		{onStateChange{time.Second, mp.STATE_PLAYING, time.Hour, true}, map[string]string{"duration": "3600.000", "seekableStartTime": "0.000", "seekableEndTime": "3600.000", "isLive": "true"}},
+		{nowPlaying{mp.PlaylistState{Playlist: []string{"a"}, Duration: time.Minute}}, map[string]string{"videoId": "a", "duration": "60.000", "seekableEndTime": ""}},
+		{nowPlaying{mp.PlaylistState{Playlist: []string{"a"}, Duration: time.Minute, Live: true}}, map[string]string{"duration": "60.000", "seekableEndTime": "60.000", "isLive": "true"}},
+		{nowPlayingPlaylist{mp.PlaylistState{Playlist: []string{"a", "b"}, Index: 1, Duration: time.Minute}}, map[string]string{"videoId": "b", "duration": "60.000", "isLive": ""}},
+		{nowPlaying{mp.PlaylistState{}}, map[string]string{"duration": ""}},
+	}
+
+	for _, test := range tests {
+		message := test.command.message()
+		for key, want := range test.want {
+			if got := message.args[key]; got != want {
+				t.Errorf("%s %+v: got %s=%q, want %q", message.command, test.command, key, got, want)
+			}
+		}
+	}
+}
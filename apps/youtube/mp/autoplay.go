@@ -0,0 +1,89 @@
+package mp
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// # Autoplay
+//
+// When autoplay is enabled and the last video of the queue is playing, the
+// player asks a NextVideoProvider which video to play next ("up next"). That
+// video is appended to the queue when the last video has finished.
+
+// Maximum time an external command may take to find the next video.
+const NEXT_VIDEO_TIMEOUT = 30 * time.Second
+
+// NextVideoProvider chooses a video to play after the given video, when the
+// queue runs out.
+type NextVideoProvider interface {
+	NextVideo(videoId string) (string, error)
+}
+
+var errNoNextVideo = errors.New("no next video")
+
+// ListProvider plays the videos from a fixed list, in order, starting again
+// at the beginning when the list is finished.
+type ListProvider struct {
+	mutex    sync.Mutex
+	videoIds []string
+	index    int
+}
+
+func NewListProvider(videoIds []string) *ListProvider {
+	return &ListProvider{videoIds: videoIds}
+}
+
+func (lp *ListProvider) NextVideo(videoId string) (string, error) {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	for range lp.videoIds {
+		next := lp.videoIds[lp.index%len(lp.videoIds)]
+		lp.index = (lp.index + 1) % len(lp.videoIds)
+		if next != videoId {
+			return next, nil
+		}
+	}
+	return "", errNoNextVideo
+}
+
+// CommandProvider runs an external command to choose the next video. The
+// current video ID is passed as the last argument, and the command should
+// print the ID of the next video.
+type CommandProvider struct {
+	command []string
+	timeout time.Duration
+}
+
+func NewCommandProvider(command []string) *CommandProvider {
+	return &CommandProvider{command, NEXT_VIDEO_TIMEOUT}
+}
+
+func (cp *CommandProvider) NextVideo(videoId string) (string, error) {
+	if len(cp.command) == 0 {
+		return "", errors.New("no autoplay command")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cp.timeout)
+	defer cancel()
+
+	args := append(append([]string{}, cp.command[1:]...), videoId)
+	output, err := exec.CommandContext(ctx, cp.command[0], args...).Output()
+	if err != nil {
+		return "", err
+	}
+
+	next := strings.TrimSpace(string(output))
+	if next == "" {
+		return "", errNoNextVideo
+	}
+	if strings.ContainsAny(next, " \t\n,") {
+		return "", errors.New("invalid video ID from autoplay command: " + next)
+	}
+	return next, nil
+}
@@ -0,0 +1,95 @@
+package mp
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestListProvider(t *testing.T) {
+	lp := NewListProvider([]string{"a", "b", "c"})
+	for i, test := range []struct {
+		current, next string
+	}{
+		{"x", "a"},
+		{"a", "b"},
+		{"x", "c"},
+		{"x", "a"}, // starts again
+		{"b", "c"}, // skips the current video
+		{"a", "b"}, // skips it when starting again
+	} {
+		next, err := lp.NextVideo(test.current)
+		if err != nil || next != test.next {
+			t.Errorf("call %d: got %q, %v, expected %q", i, next, err, test.next)
+		}
+	}
+
+	lp = NewListProvider([]string{"a"})
+	if _, err := lp.NextVideo("a"); err != errNoNextVideo {
+		t.Errorf("expected errNoNextVideo for a list with only the current video, got %v", err)
+	}
+	lp = NewListProvider(nil)
+	if _, err := lp.NextVideo("a"); err != errNoNextVideo {
+		t.Errorf("expected errNoNextVideo for an empty list, got %v", err)
+	}
+}
+
+// TestStubCommand is the command run by TestCommandProvider: the test binary
+// runs it when it is called with "--" and a mode. It does nothing as a test.
+func TestStubCommand(t *testing.T) {
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) < 3 {
+		return
+	}
+	switch mode, videoId := args[1], args[len(args)-1]; mode {
+	case "next":
+		fmt.Printf("  next-%s\n", videoId)
+	case "invalid":
+		fmt.Println("a b")
+	case "fail":
+		os.Exit(1)
+	case "sleep":
+		time.Sleep(time.Minute)
+	}
+	os.Exit(0)
+}
+
+func TestCommandProvider(t *testing.T) {
+	stub := func(mode string) *CommandProvider {
+		cp := NewCommandProvider([]string{os.Args[0], "-test.run=^TestStubCommand$", "--", mode})
+		cp.timeout = 5 * time.Second
+		return cp
+	}
+
+	next, err := stub("next").NextVideo("abc")
+	if err != nil || next != "next-abc" {
+		t.Errorf("got %q, %v", next, err)
+	}
+	if _, err := stub("empty").NextVideo("abc"); err != errNoNextVideo {
+		t.Errorf("expected errNoNextVideo for empty output, got %v", err)
+	}
+	if _, err := stub("invalid").NextVideo("abc"); err == nil {
+		t.Error("expected an error for an invalid video ID")
+	}
+	if _, err := stub("fail").NextVideo("abc"); err == nil {
+		t.Error("expected an error for a non-zero exit status")
+	}
+
+	cp := stub("sleep")
+	cp.timeout = 100 * time.Millisecond
+	start := time.Now()
+	if _, err := cp.NextVideo("abc"); err == nil {
+		t.Error("expected an error when the command times out")
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("command ran for %s", time.Since(start))
+	}
+
+	if _, err := NewCommandProvider(nil).NextVideo("abc"); err == nil {
+		t.Error("expected an error without command")
+	}
+}
@@ -5,13 +5,66 @@ import (
 )
 
 type Backend interface {
-	initialize() chan State
+	initialize() chan interface{} // sends a State or one of the events below
 	quit()
-	play(string, time.Duration, int)
-	pause()
-	resume()
+	play(string, time.Duration, int, bool) error // volume and mute state, unless the volume is negative
+	pause() error
+	resume() error
 	getPosition() (time.Duration)
-	setPosition(time.Duration)
-	setVolume(int)
-	stop()
+	getProgress() (Progress, error)
+	playing() (string, bool, error)
+	setPosition(time.Duration) error
+	setVolume(int, bool) error // volume and mute state
+	getVolume() (int, bool, error)
+	stop() error
+	notify(string, string, time.Duration)
+	getSubtitles() (SubtitleState, error)
+	setSubtitle(string) error
+	getAudioStreams() ([]AudioStream, int, error)
+	getVideoProperties() (videoProperties, error)
+	setAudioStream(int) error
+	sendKey(Key) error
+	setRate(float64) error
+}
+
+// videoProperties are the properties of the current video that are needed
+// when it starts, read together.
+type videoProperties struct {
+	progress     Progress
+	subtitles    SubtitleState
+	audioStreams []AudioStream
+	audioStream  int // index of the current audio stream, -1 when unknown
+}
+
+// connectedEvent is sent by a backend when it has (re)connected to the media
+// player.
+type connectedEvent struct{}
+
+// userStopEvent is sent by a backend when the user has stopped the video on
+// the media player. Stops caused by the backend itself aren't reported.
+type userStopEvent struct{}
+
+// avStartEvent is sent by a backend when the audio and video of a video have
+// started, some time after STATE_PLAYING. Only then all properties of the
+// video are known.
+type avStartEvent struct{}
+
+// speedEvent is sent by a backend when the playback speed has been changed on
+// the media player itself, for example to fast forward. The speed is negative
+// when rewinding.
+type speedEvent struct {
+	speed float64
+}
+
+// seekEvent is sent by a backend when the position has jumped. The position is
+// -1 when it isn't known.
+type seekEvent struct {
+	position time.Duration
+}
+
+// volumeEvent is sent by a backend when the volume has been changed on the
+// media player itself.
+type volumeEvent struct {
+	volume int
+	muted  bool
 }
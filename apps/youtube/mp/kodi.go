@@ -1,61 +1,331 @@
 package mp
 
 import (
-	"os"
+	"errors"
+	"net/url"
+	"reflect"
 	"sync"
 	"time"
 
 	"github.com/pdf/kodirpc"
 	"github.com/sargo/kodicast/log"
-	"github.com/sirupsen/logrus"
 )
 
 // Kodi is an implementation of Backend.
+//
+// The connection is made in the background, and made again when it has been
+// lost (for example, when Kodi is restarted). Meanwhile, commands fail with
+// errKodiNotConnected. A connectedEvent is sent once the connection can be
+// used.
 type Kodi struct {
-	client       *kodirpc.Client
+	settings     kodiSettings
+	keepVideo    string // not stopped on the first connect, see playing
+	events       chan interface{}
+	done         chan struct{} // closed by quit
+	lost         chan struct{} // signals that the connection may have been lost
 	running      bool
 	runningMutex sync.Mutex
+
+	conn      kodiConn // nil while not connected
+	connMutex sync.Mutex
+
+	// The stop of the active player that is caused by kodicast itself, by
+	// opening another video or by stopping it, and the item that is played,
+	// as seen in Player.OnPlay.
+	stopExpected *stopExpectation
+	playingItem  interface{}
+	stopMutex    sync.Mutex
+
+	// The active video player, as last seen in a notification or asked with
+	// Player.GetActivePlayers.
+	playerId      int
+	playerIdKnown bool
+	playerIdMutex sync.Mutex
+}
+
+// Maximum time to wait for the response to a call. Opening a video can take
+// a lot longer, as the YouTube add-on has to look up the stream first.
+const (
+	KODI_CALL_TIMEOUT = 5 * time.Second
+	KODI_OPEN_TIMEOUT = 30 * time.Second
+)
+
+// How long a stop is still expected after the call causing it has returned, as
+// the notification may arrive a little later.
+const KODI_STOP_GRACE = time.Second
+
+// How often to ask for the player state when there are no notifications.
+const KODI_POLL_INTERVAL = time.Second
+
+// How often to check whether the connection is still alive.
+const KODI_PING_INTERVAL = 10 * time.Second
+
+// Time to wait before connecting again. It doubles after every failed
+// attempt, up to the maximum.
+const (
+	KODI_RECONNECT_MIN_DELAY = time.Second
+	KODI_RECONNECT_MAX_DELAY = 30 * time.Second
+)
+
+var errKodiNotConnected = errors.New("kodi: not connected")
+
+// JSON-RPC error codes: for a method Kodi doesn't have, and for parameters it
+// doesn't know or accept.
+const (
+	KODI_METHOD_NOT_FOUND = -32601
+	KODI_INVALID_PARAMS   = -32602
+)
+
+// stopExpectation is a stop that is caused by kodicast, see expectStop.
+type stopExpectation struct {
+	item  interface{} // the item that is stopped, nil when unknown
+	until time.Time   // zero while the call causing the stop is running
+}
+
+// kodiCall is a single call in a batch, see sendBatch.
+type kodiCall struct {
+	method string
+	params interface{}
 }
 
 var kodiLogger = log.New("kodi", "log Kodi wrapper output")
 
-func (kodi *Kodi) initialize() chan State {
+func (kodi *Kodi) initialize() chan interface{} {
+	kodi.runningMutex.Lock()
+	defer kodi.runningMutex.Unlock()
 	if kodi.running {
-		panic("already initialized")
+		kodiLogger.Errln("already initialized")
+		return kodi.events
 	}
-	kodiLogger.Println("connecting")
-	logger := &logrus.Logger{
-		Out:       os.Stdout,
-		Formatter: &logrus.TextFormatter{},
-		Hooks:     make(logrus.LevelHooks),
-		Level:     logrus.DebugLevel,
+
+	settings, err := loadKodiSettings()
+	if err != nil {
+		// Checked at startup (see CheckKodi), so this shouldn't happen.
+		kodiLogger.Errln("invalid settings:", err)
 	}
-	kodirpc.SetLogger(logger)
+	kodi.settings = settings
+	kodi.events = make(chan interface{})
+	kodi.done = make(chan struct{})
+	kodi.lost = make(chan struct{}, 1)
+	kodi.running = true
+
+	go kodi.maintainConnection()
+
+	kodiLogger.Println("initialized")
+	return kodi.events
+}
+
+// maintainConnection connects to Kodi, and connects again when the connection
+// has been lost, until quit is called. On the first connect, the connection is
+// prepared before it is used, see prepare.
+func (kodi *Kodi) maintainConnection() {
+	delay := KODI_RECONNECT_MIN_DELAY
+	first := true
+	var next kodiConn // notification socket found while connected over HTTP
+	for {
+		conn, notifications := next, true
+		next = nil
+		if conn == nil {
+			kodiLogger.Println("connecting")
+			var err error
+			conn, notifications, err = dialKodi(kodi.settings)
+			if err != nil {
+				kodiLogger.Warnf("could not connect, trying again in %s: %s\n", delay, err)
+				select {
+				case <-time.After(delay):
+				case <-kodi.done:
+					return
+				}
+				delay *= 2
+				if delay > KODI_RECONNECT_MAX_DELAY {
+					delay = KODI_RECONNECT_MAX_DELAY
+				}
+				continue
+			}
+			delay = KODI_RECONNECT_MIN_DELAY
+		}
+
+		kodi.forgetPlayerId()
+		if first {
+			first = false
+			kodi.prepare(conn)
+		}
+		kodi.handleNotifications(conn)
+
+		kodi.connMutex.Lock()
+		select {
+		case <-kodi.done:
+			kodi.connMutex.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		kodi.conn = conn
+		kodi.connMutex.Unlock()
+		kodiLogger.Println("connected")
+
+		connDone := make(chan struct{})
+		if !notifications {
+			go kodi.pollState(connDone)
+		}
+		kodi.send(connectedEvent{})
+
+		next = kodi.watchConnection(conn, notifications)
+		close(connDone)
 
-	config := kodirpc.NewConfig()
-	config.ReadTimeout = 30 * time.Second
-	client, err := kodirpc.NewClient("127.0.0.1:9090", config)
+		kodi.connMutex.Lock()
+		owned := kodi.conn == conn
+		if owned {
+			kodi.conn = nil
+		}
+		kodi.connMutex.Unlock()
+		if owned {
+			// Not closed yet by quit.
+			conn.Close()
+		}
+
+		select {
+		case <-kodi.done:
+			if next != nil {
+				next.Close()
+			}
+			return
+		default:
+		}
+	}
+}
+
+// prepare stops the video Kodi is playing and opens the YouTube add-on. It is
+// done on the first connect, before the connection can be used by anything
+// else, so a video started by a remote meanwhile isn't stopped. The video that
+// is going to be resumed (keepVideo) is kept playing.
+func (kodi *Kodi) prepare(conn kodiConn) {
+	resp, err := kodi.callConn(conn, "Player.GetActivePlayers", nil, KODI_CALL_TIMEOUT)
 	if err != nil {
-		panic(err)
+		return
+	}
+	if playerId := activeVideoPlayer(resp); playerId >= 0 {
+		params := map[string]interface{}{
+			"playerid":   playerId,
+			"properties": []string{"file"},
+		}
+		resp, err := kodi.callConn(conn, "Player.GetItem", params, KODI_CALL_TIMEOUT)
+		if err == nil && kodi.keepVideo != "" && youtubeVideo(resp) == kodi.keepVideo {
+			return
+		}
+		expected := kodi.expectStopOf(playerId, nil)
+		kodi.callConn(conn, "Player.Stop", map[string]int{"playerid": playerId}, KODI_CALL_TIMEOUT)
+		kodi.stopDone(expected)
+	}
+	params := map[string]string{
+		"addonid": "plugin.video.youtube",
 	}
-	kodiLogger.Println("connected")
-	kodi.client = client
+	kodi.callConn(conn, "Addons.ExecuteAddon", params, KODI_OPEN_TIMEOUT)
+}
+
+// watchConnection returns when the connection has been lost, or when quit is
+// called. A connection without notifications is given up as soon as the
+// configured notification socket can be reached again: that connection is
+// returned.
+func (kodi *Kodi) watchConnection(conn kodiConn, notifications bool) kodiConn {
+	ticker := time.NewTicker(KODI_PING_INTERVAL)
+	defer ticker.Stop()
+	var retry <-chan time.Time
+	if !notifications && kodi.settings.transport != KODI_TRANSPORT_HTTP {
+		retryTicker := time.NewTicker(KODI_RECONNECT_MAX_DELAY)
+		defer retryTicker.Stop()
+		retry = retryTicker.C
+	}
+	for {
+		select {
+		case <-kodi.done:
+			return nil
+		case <-ticker.C:
+		case <-kodi.lost:
+		case <-retry:
+			if next, err := dialNotifications(kodi.settings); err == nil {
+				kodiLogger.Println("switching from HTTP to", kodi.settings.transport)
+				return next
+			}
+			continue
+		}
+		if _, err := kodi.callConn(conn, "JSONRPC.Ping", nil, KODI_CALL_TIMEOUT); err != nil {
+			kodiLogger.Warnln("lost connection:", err)
+			return nil
+		}
+	}
+}
 
-	// stop current video and open YT addon
-	kodi.stop()
-	kodi.openAddon()
+// send sends an event to the MediaPlayer, unless the backend has quit.
+func (kodi *Kodi) send(event interface{}) {
+	select {
+	case kodi.events <- event:
+	case <-kodi.done:
+	}
+}
 
-	eventChan := make(chan State)
-	kodi.client.Handle("Player.OnPause", func(method string, data interface{}) {
+// handleNotifications registers the notification handlers on a new
+// connection.
+func (kodi *Kodi) handleNotifications(conn kodiConn) {
+	conn.Handle("Player.OnPause", func(method string, data interface{}) {
 		kodiLogger.Println("OnPause", data)
-		eventChan <- STATE_PAUSED
+		kodi.send(STATE_PAUSED)
 	})
-	kodi.client.Handle("Player.OnPlay", func(method string, data interface{}) {
+	conn.Handle("Player.OnPlay", func(method string, data interface{}) {
 		kodiLogger.Println("OnPlay", data)
-		eventChan <- STATE_PLAYING
+		kodi.updatePlayerId(data)
+		kodi.played(data)
+		kodi.send(STATE_PLAYING)
+	})
+	conn.Handle("Player.OnResume", func(method string, data interface{}) {
+		kodiLogger.Println("OnResume", data)
+		kodi.updatePlayerId(data)
+		kodi.send(STATE_PLAYING)
 	})
-	kodi.client.Handle("Player.OnStop", func(method string, data interface{}) {
+	conn.Handle("Player.OnAVStart", func(method string, data interface{}) {
+		kodiLogger.Println("OnAVStart", data)
+		kodi.updatePlayerId(data)
+		kodi.send(avStartEvent{})
+	})
+	conn.Handle("Player.OnSpeedChanged", func(method string, data interface{}) {
+		kodiLogger.Println("OnSpeedChanged", data)
+		params, _ := data.(map[string]interface{})
+		player, _ := params["player"].(map[string]interface{})
+		speed, ok := player["speed"].(float64)
+		if !ok || speed == 0 {
+			// Pausing is handled by OnPause.
+			return
+		}
+		kodi.send(speedEvent{speed})
+	})
+	conn.Handle("Player.OnSeek", func(method string, data interface{}) {
+		kodiLogger.Println("OnSeek", data)
+		position := time.Duration(-1)
+		if params, ok := data.(map[string]interface{}); ok {
+			if player, ok := params["player"].(map[string]interface{}); ok {
+				if t, ok := parseKodiTime(player["time"]); ok {
+					position = t
+				}
+			}
+		}
+		kodi.send(seekEvent{position})
+	})
+	conn.Handle("Application.OnVolumeChanged", func(method string, data interface{}) {
+		kodiLogger.Println("OnVolumeChanged", data)
+		params, ok := data.(map[string]interface{})
+		if !ok {
+			return
+		}
+		volume, ok := params["volume"].(float64)
+		if !ok {
+			return
+		}
+		muted, _ := params["muted"].(bool)
+		kodi.send(volumeEvent{int(volume + 0.5), muted})
+	})
+	conn.Handle("Player.OnStop", func(method string, data interface{}) {
 		kodiLogger.Println("OnStop", data)
+		kodi.forgetPlayerId()
 		params, ok := data.(map[string]interface{})
 		if !ok {
 			return
@@ -64,47 +334,294 @@ func (kodi *Kodi) initialize() chan State {
 		if !ok {
 			return
 		}
+		expected := kodi.stopWasExpected(params["item"])
 		if endState {
 			// current video has finished - play next one
-			eventChan <- STATE_STOPPED
+			kodi.send(STATE_STOPPED)
+		} else if expected {
+			kodiLogger.Println("stopped by kodicast")
 		} else {
-			// user has pushed stop button - quit
-			kodi.quit()
-			close(eventChan)
+			// user has pushed stop button
+			kodi.send(userStopEvent{})
 		}
 	})
+}
 
-	kodi.running = true
-	kodiLogger.Println("initialized")
-	return eventChan
+// expectStop marks the stop of the item that the active player is playing, if
+// there is one, as caused by kodicast. It is expected until shortly after
+// stopDone is called, or until the next Player.OnPlay after that, so a stop by
+// the user after that isn't taken for it.
+func (kodi *Kodi) expectStop() *stopExpectation {
+	playerId := kodi.getPlayerId()
+	kodi.stopMutex.Lock()
+	item := kodi.playingItem
+	kodi.stopMutex.Unlock()
+	return kodi.expectStopOf(playerId, item)
+}
+
+// expectStopOf is like expectStop, for the given player and item. When the
+// item is nil, a stop of any item is expected.
+func (kodi *Kodi) expectStopOf(playerId int, item interface{}) *stopExpectation {
+	if playerId < 0 {
+		return nil
+	}
+	expected := &stopExpectation{item: item}
+	kodi.stopMutex.Lock()
+	kodi.stopExpected = expected
+	kodi.stopMutex.Unlock()
+	return expected
+}
+
+// stopDone is called when the call that causes an expected stop has returned.
+func (kodi *Kodi) stopDone(expected *stopExpectation) {
+	if expected == nil {
+		return
+	}
+	kodi.stopMutex.Lock()
+	defer kodi.stopMutex.Unlock()
+	if kodi.stopExpected == expected {
+		expected.until = time.Now().Add(KODI_STOP_GRACE)
+	}
+}
+
+// played remembers the item from a Player.OnPlay notification. A stop that was
+// expected is over once its call has returned and the next item plays.
+// Notifications are handled concurrently, so while the call is running,
+// Player.OnPlay may be handled before the Player.OnStop it follows.
+func (kodi *Kodi) played(data interface{}) {
+	params, _ := data.(map[string]interface{})
+	kodi.stopMutex.Lock()
+	defer kodi.stopMutex.Unlock()
+	kodi.playingItem = params["item"]
+	if kodi.stopExpected != nil && !kodi.stopExpected.until.IsZero() {
+		kodi.stopExpected = nil
+	}
+}
+
+// stopWasExpected returns whether the stop of an item was caused by kodicast,
+// see expectStop.
+func (kodi *Kodi) stopWasExpected(item interface{}) bool {
+	kodi.stopMutex.Lock()
+	defer kodi.stopMutex.Unlock()
+	if reflect.DeepEqual(kodi.playingItem, item) {
+		kodi.playingItem = nil
+	}
+	expected := kodi.stopExpected
+	if expected == nil {
+		return false
+	}
+	if !expected.until.IsZero() && time.Now().After(expected.until) {
+		kodi.stopExpected = nil
+		return false
+	}
+	if expected.item != nil && !reflect.DeepEqual(expected.item, item) {
+		// Another item, which may be stopped by the user.
+		return false
+	}
+	kodi.stopExpected = nil
+	return true
+}
+
+// stopPending returns whether a stop caused by kodicast is expected, like
+// stopWasExpected, but leaves the expectation in place.
+func (kodi *Kodi) stopPending() bool {
+	kodi.stopMutex.Lock()
+	defer kodi.stopMutex.Unlock()
+	expected := kodi.stopExpected
+	return expected != nil && (expected.until.IsZero() || time.Now().Before(expected.until))
+}
+
+// pollState sends the player state whenever it changes, for connections
+// without notifications. The end of a video can't be told apart from a stop by
+// the user this way, so both are treated as the end of the video. While
+// kodicast switches to another video, there is no player for a moment: that
+// isn't sent, see stopPending.
+func (kodi *Kodi) pollState(connDone chan struct{}) {
+	ticker := time.NewTicker(KODI_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	lastState := STATE_STOPPED
+	for {
+		select {
+		case <-connDone:
+			return
+		case <-ticker.C:
+		}
+
+		kodi.forgetPlayerId()
+		state := STATE_STOPPED
+		if playerId := kodi.getPlayerId(); playerId >= 0 {
+			params := map[string]interface{}{
+				"playerid":   playerId,
+				"properties": []string{"speed"},
+			}
+			resp, err := kodi.sendCommand("Player.GetProperties", params)
+			if err != nil {
+				continue
+			}
+			result, _ := resp.(map[string]interface{})
+			if speed, _ := result["speed"].(float64); speed == 0 {
+				state = STATE_PAUSED
+			} else {
+				state = STATE_PLAYING
+			}
+		}
+
+		if state == STATE_STOPPED && kodi.stopPending() {
+			// The next state is sent, also when it is the same as
+			// before the stop.
+			lastState = state
+			continue
+		}
+		if state != lastState {
+			lastState = state
+			kodi.send(state)
+		}
+	}
 }
 
-// Function quit quits the player.
-// WARNING: This MUST be the last call on this media player.
+// quit quits the player. It may be called more than once.
 func (kodi *Kodi) quit() {
 	kodi.runningMutex.Lock()
+	defer kodi.runningMutex.Unlock()
 	if !kodi.running {
-		panic("quit called twice")
-	}
-	err := kodi.client.Close()
-	if err != nil {
-		panic(err)
+		return
 	}
-	kodi.client = nil
 	kodi.running = false
-	kodi.runningMutex.Unlock()
+	close(kodi.done)
+
+	kodi.connMutex.Lock()
+	conn := kodi.conn
+	kodi.conn = nil
+	kodi.connMutex.Unlock()
+	if conn != nil {
+		if err := conn.Close(); err != nil {
+			kodiLogger.Warnln("could not close connection:", err)
+		}
+	}
 }
 
 // sendCommand sends a command to the Kodi player
 func (kodi *Kodi) sendCommand(command string, params interface{}) (interface{}, error) {
+	timeout := KODI_CALL_TIMEOUT
+	if command == "Player.Open" || command == "Addons.ExecuteAddon" {
+		timeout = KODI_OPEN_TIMEOUT
+	}
+
+	kodi.connMutex.Lock()
+	conn := kodi.conn
+	kodi.connMutex.Unlock()
+	if conn == nil {
+		kodiLogger.Println(command, errKodiNotConnected)
+		return nil, errKodiNotConnected
+	}
+
+	resp, err := kodi.callConn(conn, command, params, timeout)
+	if _, ok := err.(*kodirpc.Error); err != nil && !ok {
+		// Not an error from Kodi itself, so the connection may be broken.
+		select {
+		case kodi.lost <- struct{}{}:
+		default:
+		}
+	}
+	return resp, err
+}
+
+// callConn sends a command and waits at most timeout for the response. The
+// time the call took is logged.
+func (kodi *Kodi) callConn(conn kodiConn, command string, params interface{}, timeout time.Duration) (interface{}, error) {
 	kodiLogger.Println(command)
 	kodiLogger.Println(params)
-	resp, err := kodi.client.Call(command, params)
+
+	type result struct {
+		resp interface{}
+		err  error
+	}
+	done := make(chan result, 1)
+	start := time.Now()
+	go func() {
+		resp, err := conn.Call(command, params)
+		done <- result{resp, err}
+	}()
+
+	var res result
+	select {
+	case res = <-done:
+		kodiLogger.Printf("%s took %s\n", command, time.Since(start))
+	case <-time.After(timeout):
+		res.err = errors.New("kodi: " + command + " timed out")
+	}
+	if res.err != nil {
+		kodiLogger.Println(res.err)
+	}
+	kodiLogger.Println(res.resp)
+	return res.resp, res.err
+}
+
+// sendBatch sends several calls together and returns their results in the
+// same order. The calls are executed in order. When the connection supports
+// it, they are sent in a single JSON-RPC batch request, otherwise one after
+// the other.
+func (kodi *Kodi) sendBatch(calls []kodiCall) ([]interface{}, []error) {
+	results := make([]interface{}, len(calls))
+	errs := make([]error, len(calls))
+
+	kodi.connMutex.Lock()
+	conn := kodi.conn
+	kodi.connMutex.Unlock()
+	batcher, ok := conn.(kodiBatcher)
+	if !ok {
+		// Also when not connected: sendCommand returns the error.
+		for i, c := range calls {
+			results[i], errs[i] = kodi.sendCommand(c.method, c.params)
+		}
+		return results, errs
+	}
+
+	timeout := KODI_CALL_TIMEOUT
+	for _, c := range calls {
+		kodiLogger.Println(c.method)
+		kodiLogger.Println(c.params)
+		if c.method == "Player.Open" || c.method == "Addons.ExecuteAddon" {
+			timeout = KODI_OPEN_TIMEOUT
+		}
+	}
+
+	type batchResult struct {
+		results []interface{}
+		errs    []error
+		err     error
+	}
+	done := make(chan batchResult, 1)
+	start := time.Now()
+	go func() {
+		results, errs, err := batcher.CallBatch(calls)
+		done <- batchResult{results, errs, err}
+	}()
+
+	var err error
+	select {
+	case res := <-done:
+		kodiLogger.Printf("batch of %d calls took %s\n", len(calls), time.Since(start))
+		if res.err == nil {
+			copy(results, res.results)
+			copy(errs, res.errs)
+		}
+		err = res.err
+	case <-time.After(timeout):
+		err = errors.New("kodi: batch timed out")
+	}
 	if err != nil {
 		kodiLogger.Println(err)
+		for i := range errs {
+			errs[i] = err
+		}
+		select {
+		case kodi.lost <- struct{}{}:
+		default:
+		}
 	}
-	kodiLogger.Println(resp)
-	return resp, err
+	return results, errs
 }
 
 func (kodi *Kodi) sendPlayerCommand(command string) (interface{}, error) {
@@ -128,47 +645,182 @@ func (kodi *Kodi) openAddon() {
 	kodiLogger.Println(resp)
 }
 
-func (kodi *Kodi) play(stream string, position time.Duration, volume int) {
-	params := map[string]map[string]string{
-		"item": {
+// play starts a video. The position is passed as resume point, but the
+// YouTube add-on may not use it, so the MediaPlayer seeks again if needed once
+// the video plays. The volume and mute state are only applied when the volume
+// isn't negative.
+func (kodi *Kodi) play(stream string, position time.Duration, volume int, muted bool) error {
+	params := map[string]interface{}{
+		"item": map[string]string{
 			"file": "plugin://plugin.video.youtube/?action=play_video&videoid=" + stream,
 		},
 	}
-	resp, _ := kodi.sendCommand("Player.Open", params)
+	if position > 0 {
+		params["options"] = map[string]interface{}{
+			"resume": kodiTime(position),
+		}
+	}
+	expected := kodi.expectStop()
+	defer kodi.stopDone(expected)
+	var calls []kodiCall
+	if volume >= 0 {
+		// Before opening, so the video doesn't start at the old volume.
+		calls = append(calls, volumeCalls(volume, muted)...)
+	}
+	calls = append(calls, kodiCall{"Player.Open", params})
+	results, errs := kodi.sendBatch(calls)
+	for _, err := range errs[:len(calls)-1] {
+		if err != nil {
+			kodiLogger.Warnln("could not set volume:", err)
+		}
+	}
+	resp, err := results[len(calls)-1], errs[len(calls)-1]
+	if rpcErr, ok := err.(*kodirpc.Error); ok && rpcErr.Code == KODI_INVALID_PARAMS && position > 0 {
+		// Older versions of Kodi don't know the resume option. Other
+		// errors aren't retried: the video may have been opened anyway,
+		// or opening it may take just as long again.
+		delete(params, "options")
+		resp, err = kodi.sendCommand("Player.Open", params)
+	}
 	kodiLogger.Println(resp)
+	return err
+}
+
+// playing returns the YouTube video that is currently played by Kodi, or an
+// empty string if there is none, and whether it is paused.
+func (kodi *Kodi) playing() (string, bool, error) {
+	kodi.connMutex.Lock()
+	conn := kodi.conn
+	kodi.connMutex.Unlock()
+	if conn == nil {
+		// Not the same as not playing anything.
+		return "", false, errKodiNotConnected
+	}
+	playerId := kodi.getPlayerId()
+	if playerId < 0 {
+		return "", false, nil
+	}
+	results, errs := kodi.sendBatch([]kodiCall{
+		{"Player.GetItem", map[string]interface{}{
+			"playerid":   playerId,
+			"properties": []string{"file"},
+		}},
+		{"Player.GetProperties", map[string]interface{}{
+			"playerid":   playerId,
+			"properties": []string{"speed"},
+		}},
+	})
+	for _, err := range errs {
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	properties, _ := results[1].(map[string]interface{})
+	speed, _ := properties["speed"].(float64)
+	return youtubeVideo(results[0]), speed == 0, nil
+}
+
+// youtubeVideo returns the YouTube video in the result of Player.GetItem, or
+// an empty string if the item isn't played by the YouTube add-on.
+func youtubeVideo(resp interface{}) string {
+	result, _ := resp.(map[string]interface{})
+	item, _ := result["item"].(map[string]interface{})
+	file, _ := item["file"].(string)
+	fileURL, err := url.Parse(file)
+	if err != nil || fileURL.Scheme != "plugin" || fileURL.Host != "plugin.video.youtube" {
+		return ""
+	}
+	return fileURL.Query().Get("videoid")
 }
 
+// kodiTime converts a duration to a Kodi time object (Global.Time).
+func kodiTime(t time.Duration) map[string]int64 {
+	return map[string]int64{
+		"hours":        int64(t / time.Hour),
+		"minutes":      int64(t/time.Minute) % 60,
+		"seconds":      int64(t/time.Second) % 60,
+		"milliseconds": int64(t/time.Millisecond) % 1000,
+	}
+}
+
+// getPlayerId returns the ID of the active video player, or -1 if there is
+// none. Kodi is only asked when no player has been seen in a notification.
 func (kodi *Kodi) getPlayerId() int {
+	kodi.playerIdMutex.Lock()
+	playerId, known := kodi.playerId, kodi.playerIdKnown
+	kodi.playerIdMutex.Unlock()
+	if known {
+		return playerId
+	}
+
 	resp, err := kodi.sendCommand("Player.GetActivePlayers", nil)
 	if err != nil {
 		return -1
 	}
+	playerId = activeVideoPlayer(resp)
+	if playerId >= 0 {
+		kodi.setPlayerId(playerId)
+	}
+	return playerId
+}
 
-	result := resp.([]interface{})
+// activeVideoPlayer returns the video player in the result of
+// Player.GetActivePlayers, or -1 if there is none.
+func activeVideoPlayer(resp interface{}) int {
+	result, _ := resp.([]interface{})
 	for _, i := range result {
-		item := i.(map[string]interface{})
-		playerType := item["type"].(string)
-		if playerType == "video" {
-			return int(item["playerid"].(float64))
+		item, _ := i.(map[string]interface{})
+		playerType, _ := item["type"].(string)
+		id, ok := item["playerid"].(float64)
+		if playerType == "video" && ok {
+			return int(id)
 		}
 	}
-
 	return -1
 }
 
-func (kodi *Kodi) pause() {
-	result, _ := kodi.sendPlayerCommand("Player.PlayPause")
+func (kodi *Kodi) setPlayerId(playerId int) {
+	kodi.playerIdMutex.Lock()
+	kodi.playerId = playerId
+	kodi.playerIdKnown = true
+	kodi.playerIdMutex.Unlock()
+}
+
+func (kodi *Kodi) forgetPlayerId() {
+	kodi.playerIdMutex.Lock()
+	kodi.playerIdKnown = false
+	kodi.playerIdMutex.Unlock()
+}
+
+// updatePlayerId remembers the player from a Player.* notification.
+func (kodi *Kodi) updatePlayerId(data interface{}) {
+	params, _ := data.(map[string]interface{})
+	player, _ := params["player"].(map[string]interface{})
+	if id, ok := player["playerid"].(float64); ok {
+		kodi.setPlayerId(int(id))
+	}
+}
+
+func (kodi *Kodi) pause() error {
+	result, err := kodi.sendPlayerCommand("Player.PlayPause")
 	kodiLogger.Println(result)
+	return err
 }
 
-func (kodi *Kodi) resume() {
-	result, _ := kodi.sendPlayerCommand("Player.PlayPause")
+func (kodi *Kodi) resume() error {
+	result, err := kodi.sendPlayerCommand("Player.PlayPause")
 	kodiLogger.Println(result)
+	return err
 }
 
 func (kodi *Kodi) getPosition() time.Duration {
+	playerId := kodi.getPlayerId()
+	if playerId < 0 {
+		return 0
+	}
 	params := map[string]interface{}{
-		"playerid":   kodi.getPlayerId(),
+		"playerid":   playerId,
 		"properties": [1]string{"time"},
 	}
 	resp, err := kodi.sendCommand("Player.GetProperties", params)
@@ -176,42 +828,392 @@ func (kodi *Kodi) getPosition() time.Duration {
 		return 0
 	}
 
-	result := resp.(map[string]interface{})
-	timeData := result["time"].(map[string]interface{})
-	hours := int64(timeData["hours"].(float64))
-	minutes := int64(timeData["minutes"].(float64))
-	seconds := int64(timeData["seconds"].(float64))
+	result, ok := resp.(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	position, _ := parseKodiTime(result["time"])
+	return position
+}
+
+// getProgress returns the position and duration of the current video, and
+// whether it is a live stream.
+func (kodi *Kodi) getProgress() (Progress, error) {
+	playerId := kodi.getPlayerId()
+	if playerId < 0 {
+		return Progress{}, PROPERTY_UNAVAILABLE
+	}
+	return parseProgress(kodi.sendCommand("Player.GetProperties", playerProperties(playerId, progressProperties)))
+}
 
-	hour := int64(time.Hour)
-	minute := int64(time.Minute)
-	second := int64(time.Second)
-	position := time.Duration(hours*hour + minutes*minute + seconds*second)
+// Player properties read by getProgress, getSubtitles and getAudioStreams.
+var (
+	progressProperties    = []string{"time", "totaltime", "live"}
+	subtitleProperties    = []string{"subtitles", "currentsubtitle", "subtitleenabled"}
+	audioStreamProperties = []string{"audiostreams", "currentaudiostream"}
+)
 
-	return position
+// playerProperties returns the parameters of Player.GetProperties.
+func playerProperties(playerId int, properties []string) map[string]interface{} {
+	return map[string]interface{}{
+		"playerid":   playerId,
+		"properties": properties,
+	}
 }
 
-func (kodi *Kodi) setPosition(position time.Duration) {
+// parseProgress converts the response to Player.GetProperties with the
+// progressProperties.
+func parseProgress(resp interface{}, err error) (Progress, error) {
+	progress := Progress{}
+	if err != nil {
+		return progress, err
+	}
+
+	result, ok := resp.(map[string]interface{})
+	if !ok {
+		return progress, PROPERTY_UNAVAILABLE
+	}
+	position, ok := parseKodiTime(result["time"])
+	if !ok {
+		return progress, PROPERTY_UNAVAILABLE
+	}
+	progress.Position = position
+	progress.Duration, _ = parseKodiTime(result["totaltime"])
+	progress.Live, _ = result["live"].(bool)
+	return progress, nil
+}
+
+// getVideoProperties returns the progress, subtitles and audio streams of the
+// current video, read in a single batch.
+func (kodi *Kodi) getVideoProperties() (videoProperties, error) {
+	props := videoProperties{}
+	playerId := kodi.getPlayerId()
+	if playerId < 0 {
+		return props, PROPERTY_UNAVAILABLE
+	}
+	results, errs := kodi.sendBatch([]kodiCall{
+		{"Player.GetProperties", playerProperties(playerId, progressProperties)},
+		{"Player.GetProperties", playerProperties(playerId, subtitleProperties)},
+		{"Player.GetProperties", playerProperties(playerId, audioStreamProperties)},
+	})
+
+	var err error
+	if props.progress, err = parseProgress(results[0], errs[0]); err != nil {
+		return props, err
+	}
+	if props.subtitles, err = parseSubtitles(results[1], errs[1]); err != nil {
+		return props, err
+	}
+	props.audioStreams, props.audioStream, err = parseAudioStreams(results[2], errs[2])
+	return props, err
+}
+
+// parseKodiTime converts a Kodi time object (Global.Time).
+func parseKodiTime(data interface{}) (time.Duration, bool) {
+	timeData, ok := data.(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	hours, _ := timeData["hours"].(float64)
+	minutes, _ := timeData["minutes"].(float64)
+	seconds, _ := timeData["seconds"].(float64)
+	milliseconds, _ := timeData["milliseconds"].(float64)
+	return time.Duration(hours)*time.Hour +
+		time.Duration(minutes)*time.Minute +
+		time.Duration(seconds)*time.Second +
+		time.Duration(milliseconds)*time.Millisecond, true
+}
+
+func (kodi *Kodi) setPosition(position time.Duration) error {
+	playerId := kodi.getPlayerId()
+	if playerId < 0 {
+		return PROPERTY_UNAVAILABLE
+	}
 	params := map[string]interface{}{
-		"playerid": kodi.getPlayerId(),
-		"value": map[string]int64{
-			"hours":   int64(position.Hours()) % 24,
-			"minutes": int64(position.Minutes()) % 60,
-			"seconds": int64(position.Seconds()) % 60,
-		},
+		"playerid": playerId,
+		"value":    kodiTime(position),
 	}
-	result, _ := kodi.sendCommand("Player.Seek", params)
+	result, err := kodi.sendCommand("Player.Seek", params)
 	kodiLogger.Println(result)
+	return err
 }
 
-func (kodi *Kodi) setVolume(volume int) {
-	params := map[string]int{
-		"volume": volume,
+// setVolume sets the volume and mute state in a single batch.
+func (kodi *Kodi) setVolume(volume int, muted bool) error {
+	_, errs := kodi.sendBatch(volumeCalls(volume, muted))
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// volumeCalls returns the calls that set the volume and mute state.
+func volumeCalls(volume int, muted bool) []kodiCall {
+	return []kodiCall{
+		{"Application.SetVolume", map[string]int{"volume": volume}},
+		{"Application.SetMute", map[string]bool{"mute": muted}},
+	}
+}
+
+// getVolume returns the volume and whether the sound is muted.
+func (kodi *Kodi) getVolume() (int, bool, error) {
+	params := map[string]interface{}{
+		"properties": []string{"volume", "muted"},
+	}
+	resp, err := kodi.sendCommand("Application.GetProperties", params)
+	if err != nil {
+		return 0, false, err
+	}
+	result, _ := resp.(map[string]interface{})
+	volume, ok := result["volume"].(float64)
+	if !ok {
+		return 0, false, PROPERTY_UNAVAILABLE
+	}
+	muted, _ := result["muted"].(bool)
+	return int(volume + 0.5), muted, nil
+}
+
+func (kodi *Kodi) stop() error {
+	expected := kodi.expectStop()
+	defer kodi.stopDone(expected)
+	result, err := kodi.sendPlayerCommand("Player.Stop")
+	kodiLogger.Println(result)
+	return err
+}
+
+// notify shows a notification (toast) on the screen.
+func (kodi *Kodi) notify(title, message string, displayTime time.Duration) {
+	params := map[string]interface{}{
+		"title":       title,
+		"message":     message,
+		"image":       "info",
+		"displaytime": int(displayTime / time.Millisecond),
 	}
-	result, _ := kodi.sendCommand("Application.SetVolume", params)
+	result, _ := kodi.sendCommand("GUI.ShowNotification", params)
 	kodiLogger.Println(result)
 }
 
-func (kodi *Kodi) stop() {
-	result, _ := kodi.sendPlayerCommand("Player.Stop")
+// getSubtitles returns the subtitle tracks of the current video.
+func (kodi *Kodi) getSubtitles() (SubtitleState, error) {
+	playerId := kodi.getPlayerId()
+	if playerId < 0 {
+		return SubtitleState{}, PROPERTY_UNAVAILABLE
+	}
+	return parseSubtitles(kodi.sendCommand("Player.GetProperties", playerProperties(playerId, subtitleProperties)))
+}
+
+// parseSubtitles converts the response to Player.GetProperties with the
+// subtitleProperties.
+func parseSubtitles(resp interface{}, err error) (SubtitleState, error) {
+	state := SubtitleState{}
+	if err != nil {
+		return state, err
+	}
+
+	result, ok := resp.(map[string]interface{})
+	if !ok {
+		return state, PROPERTY_UNAVAILABLE
+	}
+	state.Enabled, _ = result["subtitleenabled"].(bool)
+	state.Current, _ = parseSubtitle(result["currentsubtitle"])
+	if subtitles, ok := result["subtitles"].([]interface{}); ok {
+		for _, data := range subtitles {
+			if subtitle, ok := parseSubtitle(data); ok {
+				state.Available = append(state.Available, subtitle)
+			}
+		}
+	}
+	return state, nil
+}
+
+// parseSubtitle converts a subtitle as returned by Kodi.
+func parseSubtitle(data interface{}) (Subtitle, bool) {
+	item, ok := data.(map[string]interface{})
+	if !ok {
+		return Subtitle{}, false
+	}
+	index, ok := item["index"].(float64)
+	if !ok {
+		// Kodi returns an empty object when there is no current subtitle.
+		return Subtitle{}, false
+	}
+	language, _ := item["language"].(string)
+	name, _ := item["name"].(string)
+	return Subtitle{int(index), normalizeLanguage(language), name}, true
+}
+
+// setSubtitle shows the first subtitle track in the language, or turns
+// subtitles off when the language is empty.
+func (kodi *Kodi) setSubtitle(language string) error {
+	playerId := kodi.getPlayerId()
+	if playerId < 0 {
+		return PROPERTY_UNAVAILABLE
+	}
+
+	params := map[string]interface{}{
+		"playerid": playerId,
+		"subtitle": "off",
+	}
+	if language != "" {
+		state, err := kodi.getSubtitles()
+		if err != nil {
+			return err
+		}
+		subtitle, ok := findSubtitle(state.Available, language)
+		if !ok {
+			return errors.New("no subtitles in language " + language)
+		}
+		params["subtitle"] = subtitle.Index
+		params["enable"] = true
+	}
+
+	result, err := kodi.sendCommand("Player.SetSubtitle", params)
 	kodiLogger.Println(result)
+	return err
+}
+
+// getAudioStreams returns the audio streams of the current video, and the
+// index of the current stream.
+func (kodi *Kodi) getAudioStreams() ([]AudioStream, int, error) {
+	playerId := kodi.getPlayerId()
+	if playerId < 0 {
+		return nil, -1, PROPERTY_UNAVAILABLE
+	}
+	return parseAudioStreams(kodi.sendCommand("Player.GetProperties", playerProperties(playerId, audioStreamProperties)))
+}
+
+// parseAudioStreams converts the response to Player.GetProperties with the
+// audioStreamProperties.
+func parseAudioStreams(resp interface{}, err error) ([]AudioStream, int, error) {
+	if err != nil {
+		return nil, -1, err
+	}
+
+	result, ok := resp.(map[string]interface{})
+	if !ok {
+		return nil, -1, PROPERTY_UNAVAILABLE
+	}
+	current := -1
+	if stream, ok := parseAudioStream(result["currentaudiostream"]); ok {
+		current = stream.Index
+	}
+	var streams []AudioStream
+	if data, ok := result["audiostreams"].([]interface{}); ok {
+		for _, item := range data {
+			if stream, ok := parseAudioStream(item); ok {
+				streams = append(streams, stream)
+			}
+		}
+	}
+	return streams, current, nil
+}
+
+// parseAudioStream converts an audio stream as returned by Kodi.
+func parseAudioStream(data interface{}) (AudioStream, bool) {
+	item, ok := data.(map[string]interface{})
+	if !ok {
+		return AudioStream{}, false
+	}
+	index, ok := item["index"].(float64)
+	if !ok {
+		return AudioStream{}, false
+	}
+	language, _ := item["language"].(string)
+	name, _ := item["name"].(string)
+	return AudioStream{int(index), normalizeLanguage(language), name}, true
+}
+
+// setAudioStream switches to another audio stream of the current video.
+func (kodi *Kodi) setAudioStream(index int) error {
+	playerId := kodi.getPlayerId()
+	if playerId < 0 {
+		return PROPERTY_UNAVAILABLE
+	}
+	params := map[string]interface{}{
+		"playerid": playerId,
+		"stream":   index,
+	}
+	result, err := kodi.sendCommand("Player.SetAudioStream", params)
+	kodiLogger.Println(result)
+	return err
+}
+
+// Keys that map to Input.* methods: these navigate the user interface.
+var kodiInputMethods = map[Key]string{
+	KEY_UP:    "Input.Up",
+	KEY_DOWN:  "Input.Down",
+	KEY_LEFT:  "Input.Left",
+	KEY_RIGHT: "Input.Right",
+	KEY_ENTER: "Input.Select",
+	KEY_BACK:  "Input.Back",
+	KEY_HOME:  "Input.Home",
+	KEY_MENU:  "Input.ContextMenu",
+	KEY_INFO:  "Input.Info",
+}
+
+// Keys that map to actions for Input.ExecuteAction.
+var kodiInputActions = map[Key]string{
+	KEY_PLAY_PAUSE:  "playpause",
+	KEY_STOP:        "stop",
+	KEY_FAST_FWD:    "fastforward",
+	KEY_REWIND:      "rewind",
+	KEY_VOLUME_UP:   "volumeup",
+	KEY_VOLUME_DOWN: "volumedown",
+	KEY_MUTE:        "mute",
+	KEY_SUBTITLES:   "showsubtitles",
+}
+
+// sendKey sends a key press to the user interface.
+func (kodi *Kodi) sendKey(key Key) error {
+	if method, ok := kodiInputMethods[key]; ok {
+		result, err := kodi.sendCommand(method, nil)
+		kodiLogger.Println(result)
+		return err
+	}
+	if action, ok := kodiInputActions[key]; ok {
+		params := map[string]string{
+			"action": action,
+		}
+		result, err := kodi.sendCommand("Input.ExecuteAction", params)
+		kodiLogger.Println(result)
+		return err
+	}
+	return ErrUnsupportedKey
+}
+
+// setRate changes the playback speed, by changing the tempo. That requires
+// Kodi 19 or newer, and by default Kodi only allows a tempo between 0.8 and
+// 1.5. Other speeds return ErrUnsupportedRate: Player.SetSpeed isn't used, as
+// it fast forwards without sound instead of changing the playback speed.
+func (kodi *Kodi) setRate(rate float64) error {
+	playerId := kodi.getPlayerId()
+	if playerId < 0 {
+		return PROPERTY_UNAVAILABLE
+	}
+
+	if rate == 1 {
+		// The user may also have fast forwarded on Kodi itself.
+		if _, err := kodi.sendCommand("Player.SetSpeed", map[string]interface{}{
+			"playerid": playerId,
+			"speed":    1,
+		}); err != nil {
+			return err
+		}
+	}
+
+	_, err := kodi.sendCommand("Player.SetTempo", map[string]interface{}{
+		"playerid": playerId,
+		"tempo":    rate,
+	})
+	if rpcErr, ok := err.(*kodirpc.Error); ok {
+		if rate == 1 && rpcErr.Code == KODI_METHOD_NOT_FOUND {
+			// Older versions of Kodi always play at tempo 1.
+			return nil
+		}
+		kodiLogger.Warnln("Kodi can't play at speed", rate, "-", rpcErr)
+		return ErrUnsupportedRate
+	}
+	return err
 }
@@ -0,0 +1,280 @@
+package mp
+
+import (
+	"flag"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pdf/kodirpc"
+)
+
+func TestPlayBeforeConnected(t *testing.T) {
+	// Kodi doesn't answer until the video has been played.
+	fake := &fakeKodiHTTP{hold: make(chan struct{})}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	flag.Set("no-config", "true")
+	flag.Set("kodi-transport", "http")
+	flag.Set("kodi-host", host)
+	flag.Set("kodi-http-port", port)
+
+	stateChange := make(chan StateChange)
+	events := make(chan Event)
+	go func() {
+		for range stateChange {
+		}
+	}()
+	go func() {
+		for range events {
+		}
+	}()
+	p := New(stateChange, events, nil, false, "")
+	defer p.Quit()
+
+	p.SetPlaystate([]string{"video"}, 0, 0, "")
+	deadline := time.Now().Add(5 * time.Second)
+	for pending := ""; pending != "video"; {
+		if time.Now().After(deadline) {
+			t.Fatal("video isn't pending")
+		}
+		time.Sleep(10 * time.Millisecond)
+		p.getPlayState(func(ps *PlayState) {
+			pending = ps.pendingVideo
+		})
+	}
+	close(fake.hold)
+
+	// The video must be played once connected, after the add-on has been
+	// opened.
+	for {
+		fake.mutex.Lock()
+		methods := strings.Join(fake.methods, ",")
+		fake.mutex.Unlock()
+		if strings.Contains(methods, "Player.Open") {
+			if addon := strings.Index(methods, "Addons.ExecuteAddon"); addon < 0 || addon > strings.Index(methods, "Player.Open") {
+				t.Errorf("video played before preparing Kodi: %s", methods)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("video not played, calls: %s", methods)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStopExpected(t *testing.T) {
+	itemA := map[string]interface{}{"type": "unknown", "title": "A"}
+	itemB := map[string]interface{}{"type": "unknown", "title": "B"}
+	onPlay := func(item interface{}) interface{} {
+		return map[string]interface{}{
+			"item":   item,
+			"player": map[string]interface{}{"playerid": float64(1)},
+		}
+	}
+	kodi := &Kodi{}
+	kodi.setPlayerId(1)
+
+	if kodi.stopWasExpected(itemA) {
+		t.Error("stop expected without a call")
+	}
+
+	// Opening B: Player.OnPlay of B may be handled before Player.OnStop of A.
+	kodi.played(onPlay(itemA))
+	expected := kodi.expectStop()
+	kodi.played(onPlay(itemB))
+	if !kodi.stopWasExpected(itemA) {
+		t.Error("stop caused by opening a video not expected")
+	}
+	kodi.stopDone(expected)
+	if kodi.stopWasExpected(itemB) {
+		t.Error("a stop is expected twice")
+	}
+
+	// The stop of another item isn't expected.
+	kodi.played(onPlay(itemB))
+	expected = kodi.expectStop()
+	if kodi.stopWasExpected(itemA) {
+		t.Error("stop of another item expected")
+	}
+	kodi.stopDone(expected)
+
+	// Nor a stop after the call has returned and the next item plays.
+	kodi.played(onPlay(itemB))
+	if kodi.stopWasExpected(itemB) {
+		t.Error("stop after the next Player.OnPlay expected")
+	}
+
+	// Nor long after the call has returned.
+	expected = kodi.expectStop()
+	kodi.stopDone(expected)
+	expected.until = time.Now().Add(-time.Millisecond)
+	if kodi.stopWasExpected(itemB) {
+		t.Error("stop expected after the call has returned")
+	}
+}
+
+func TestPlayResumeFallback(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		code  int    // error for Player.Open with the resume option
+		calls string // expected calls
+	}{
+		{"invalid params", KODI_INVALID_PARAMS, "Player.Open,Player.Open"},
+		{"other error", -32100, "Player.Open"},
+	} {
+		code := test.code
+		withOptions := 0
+		fake := &fakeKodiHTTP{fail: func(req kodiRequest) *kodirpc.Error {
+			params, _ := req.Params.(map[string]interface{})
+			if _, ok := params["options"]; ok && req.Method == "Player.Open" {
+				withOptions++
+				return &kodirpc.Error{Code: code, Message: "Invalid params."}
+			}
+			return nil
+		}}
+		server := httptest.NewServer(fake)
+
+		kodi := &Kodi{lost: make(chan struct{}, 1)}
+		kodi.setPlayerId(-1)
+		kodi.conn = newKodiHTTPConn(server.Listener.Addr().String(), "", "")
+		err := kodi.play("video", time.Minute, -1, false)
+		server.Close()
+
+		if calls := strings.Join(fake.methods, ","); calls != test.calls || withOptions != 1 {
+			t.Errorf("%s: got calls %s, %d with the resume option", test.name, calls, withOptions)
+		}
+		if (err == nil) != (test.calls != "Player.Open") {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+}
+
+func TestSetVolume(t *testing.T) {
+	fake := &fakeKodiHTTP{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	kodi := &Kodi{lost: make(chan struct{}, 1)}
+	kodi.conn = newKodiHTTPConn(server.Listener.Addr().String(), "", "")
+	if err := kodi.setVolume(30, true); err != nil {
+		t.Fatal(err)
+	}
+	if fake.requests != 1 || strings.Join(fake.methods, ",") != "Application.SetVolume,Application.SetMute" {
+		t.Errorf("volume set with %d requests: %v", fake.requests, fake.methods)
+	}
+}
+
+// fakeKodiPlayer plays videos for a fakeKodiHTTP. Like Kodi, it has no active
+// player for a moment while it switches to another video.
+type fakeKodiPlayer struct {
+	mutex   sync.Mutex
+	current string // video that is playing, empty when none
+	opened  []string
+}
+
+func (f *fakeKodiPlayer) result(req kodiRequest) interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch req.Method {
+	case "Player.GetActivePlayers":
+		if f.current == "" {
+			return []interface{}{}
+		}
+		return []interface{}{map[string]interface{}{"playerid": 1, "type": "video"}}
+	case "Player.GetItem":
+		return map[string]interface{}{"item": map[string]interface{}{
+			"file": "plugin://plugin.video.youtube/?action=play_video&videoid=" + f.current,
+		}}
+	case "Player.GetProperties":
+		return map[string]interface{}{"speed": 1, "time": kodiTime(0), "totaltime": kodiTime(time.Minute)}
+	case "Player.Open":
+		// The parameters have an item like the result of Player.GetItem.
+		videoId := youtubeVideo(req.Params)
+		f.opened = append(f.opened, videoId)
+		f.current = ""
+		time.AfterFunc(1200*time.Millisecond, func() {
+			f.mutex.Lock()
+			defer f.mutex.Unlock()
+			if f.opened[len(f.opened)-1] == videoId {
+				f.current = videoId
+			}
+		})
+	}
+	return nil
+}
+
+// end ends the current video.
+func (f *fakeKodiPlayer) end() {
+	f.mutex.Lock()
+	f.current = ""
+	f.mutex.Unlock()
+}
+
+func TestPlayQueueHTTP(t *testing.T) {
+	kodiPlayer := &fakeKodiPlayer{}
+	server := httptest.NewServer(&fakeKodiHTTP{result: kodiPlayer.result})
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	flag.Set("no-config", "true")
+	flag.Set("kodi-transport", "http")
+	flag.Set("kodi-host", host)
+	flag.Set("kodi-http-port", port)
+
+	stateChange := make(chan StateChange)
+	events := make(chan Event)
+	go func() {
+		for range stateChange {
+		}
+	}()
+	go func() {
+		for range events {
+		}
+	}()
+	p := New(stateChange, events, nil, false, "")
+	defer p.Quit()
+
+	waitPlaying := func(videoId string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var video string
+			var state State
+			p.getPlayState(func(ps *PlayState) {
+				video, state = ps.Video(), ps.State
+			})
+			if video == videoId && state == STATE_PLAYING {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s isn't playing, got %s in state %d", videoId, video, state)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	p.SetPlaystate([]string{"a", "b", "c", "d"}, 0, 0, "")
+	waitPlaying("a")
+
+	// The remote chooses c: the moment Kodi has no player while it
+	// switches to c isn't the end of c.
+	p.SetVideo("c", 0)
+	waitPlaying("c")
+	time.Sleep(KODI_POLL_INTERVAL)
+	waitPlaying("c")
+
+	// When c ends, the queue continues.
+	kodiPlayer.end()
+	waitPlaying("d")
+
+	kodiPlayer.mutex.Lock()
+	opened := strings.Join(kodiPlayer.opened, ",")
+	kodiPlayer.mutex.Unlock()
+	if opened != "a,c,d" {
+		t.Errorf("opened %s", opened)
+	}
+}
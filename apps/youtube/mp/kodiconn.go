@@ -0,0 +1,227 @@
+package mp
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pdf/kodirpc"
+	"github.com/sargo/kodicast/config"
+)
+
+// # Connecting to Kodi
+//
+// Kodi is controlled with JSON-RPC. Notifications (play, pause, ...) are only
+// sent over the raw TCP socket or over a WebSocket, both on port 9090 by
+// default. Kodi also serves JSON-RPC over HTTP (the web server, port 8080 by
+// default, optionally protected by a username and password). That is used when
+// the notification socket is unavailable. As there are no notifications over
+// HTTP, the player state is polled instead.
+//
+// The settings are read from these config keys, and can be overridden with
+// the flags of the same name (kodi-host, kodi-port, ...):
+//     kodi.host
+//     kodi.port
+//     kodi.transport (tcp, websocket or http)
+//     kodi.http.port
+//     kodi.http.username
+//     kodi.http.password
+
+const (
+	KODI_TRANSPORT_TCP       = "tcp"
+	KODI_TRANSPORT_WEBSOCKET = "websocket"
+	KODI_TRANSPORT_HTTP      = "http"
+)
+
+var (
+	flagKodiHost      = flag.String("kodi-host", "", "Kodi host (default 127.0.0.1)")
+	flagKodiPort      = flag.Int("kodi-port", 0, "Kodi JSON-RPC port for notifications (default 9090)")
+	flagKodiTransport = flag.String("kodi-transport", "", "Kodi JSON-RPC transport: tcp, websocket or http (default tcp)")
+	flagKodiHTTPPort  = flag.Int("kodi-http-port", 0, "Kodi web server port (default 8080)")
+	flagKodiUsername  = flag.String("kodi-username", "", "Kodi web server username")
+	flagKodiPassword  = flag.String("kodi-password", "", "Kodi web server password")
+)
+
+// kodiSettings describes how to connect to Kodi.
+type kodiSettings struct {
+	host      string
+	port      int
+	transport string
+	httpPort  int
+	username  string
+	password  string
+}
+
+func (s kodiSettings) address() string {
+	return net.JoinHostPort(s.host, strconv.Itoa(s.port))
+}
+
+func (s kodiSettings) httpAddress() string {
+	return net.JoinHostPort(s.host, strconv.Itoa(s.httpPort))
+}
+
+// loadKodiSettings reads the connection settings from the config and the
+// flags, and checks them.
+func loadKodiSettings() (kodiSettings, error) {
+	c := config.Get()
+	s := kodiSettings{}
+	var err error
+
+	s.host, err = c.GetString("kodi.host", func() (string, error) {
+		return "127.0.0.1", nil
+	})
+	if err != nil {
+		return s, err
+	}
+	s.port, err = c.GetInt("kodi.port", func() (int, error) {
+		return 9090, nil
+	})
+	if err != nil {
+		return s, err
+	}
+	s.transport, err = c.GetString("kodi.transport", func() (string, error) {
+		return KODI_TRANSPORT_TCP, nil
+	})
+	if err != nil {
+		return s, err
+	}
+	s.httpPort, err = c.GetInt("kodi.http.port", func() (int, error) {
+		return 8080, nil
+	})
+	if err != nil {
+		return s, err
+	}
+	s.username, err = c.GetString("kodi.http.username", func() (string, error) {
+		return "", nil
+	})
+	if err != nil {
+		return s, err
+	}
+	s.password, err = c.GetString("kodi.http.password", func() (string, error) {
+		return "", nil
+	})
+	if err != nil {
+		return s, err
+	}
+
+	if *flagKodiHost != "" {
+		s.host = *flagKodiHost
+	}
+	if *flagKodiPort != 0 {
+		s.port = *flagKodiPort
+	}
+	if *flagKodiTransport != "" {
+		s.transport = *flagKodiTransport
+	}
+	if *flagKodiHTTPPort != 0 {
+		s.httpPort = *flagKodiHTTPPort
+	}
+	if *flagKodiUsername != "" {
+		s.username = *flagKodiUsername
+	}
+	if *flagKodiPassword != "" {
+		s.password = *flagKodiPassword
+	}
+
+	return s, s.check()
+}
+
+// check returns an error when the settings can't be valid.
+func (s kodiSettings) check() error {
+	if s.host == "" {
+		return errors.New("kodi: no host")
+	}
+	if s.port <= 0 || s.port > 65535 {
+		return fmt.Errorf("kodi: invalid port %d", s.port)
+	}
+	if s.httpPort <= 0 || s.httpPort > 65535 {
+		return fmt.Errorf("kodi: invalid HTTP port %d", s.httpPort)
+	}
+	switch s.transport {
+	case KODI_TRANSPORT_TCP, KODI_TRANSPORT_WEBSOCKET, KODI_TRANSPORT_HTTP:
+	default:
+		return fmt.Errorf("kodi: unknown transport %q (must be tcp, websocket or http)", s.transport)
+	}
+	if s.password != "" && s.username == "" {
+		return errors.New("kodi: password without username")
+	}
+	return nil
+}
+
+// kodiConn is a JSON-RPC connection to Kodi: kodiTCPConn, kodiWebSocketConn or
+// kodiHTTPConn.
+type kodiConn interface {
+	Call(method string, params interface{}) (interface{}, error)
+	Handle(method string, handler kodirpc.NotificationHandler)
+	Close() error
+}
+
+// kodiBatcher is implemented by connections that can send JSON-RPC batch
+// requests: the calls are sent in a single request, which Kodi executes in
+// order, and answered in a single response. All transports implement it. The
+// returned error is set when the request failed as a whole, otherwise every
+// call has its own result and error.
+type kodiBatcher interface {
+	CallBatch(calls []kodiCall) ([]interface{}, []error, error)
+}
+
+// dialKodi connects to Kodi with the configured transport. When the
+// notification socket can't be reached, it falls back to HTTP. The returned
+// bool is true when the connection sends notifications.
+func dialKodi(s kodiSettings) (kodiConn, bool, error) {
+	if s.transport != KODI_TRANSPORT_HTTP {
+		conn, err := dialNotifications(s)
+		if err == nil {
+			return conn, true, nil
+		}
+		kodiLogger.Warnln("could not connect to the notification socket, falling back to HTTP:", err)
+	}
+
+	httpConn := newKodiHTTPConn(s.httpAddress(), s.username, s.password)
+	if _, err := httpConn.Call("JSONRPC.Ping", nil); err != nil {
+		httpConn.Close()
+		return nil, false, err
+	}
+	return httpConn, false, nil
+}
+
+// dialNotifications connects to the notification socket of Kodi, with the
+// configured transport, which must not be HTTP.
+func dialNotifications(s kodiSettings) (kodiConn, error) {
+	if s.transport == KODI_TRANSPORT_WEBSOCKET {
+		return dialKodiWebSocket(s.address())
+	}
+	return dialKodiTCP(s.address())
+}
+
+// CheckKodi checks the Kodi connection settings, so mistakes are found at
+// startup. An error is only returned for invalid settings: Kodi itself may
+// not be running yet.
+func CheckKodi() error {
+	s, err := loadKodiSettings()
+	if err != nil {
+		return err
+	}
+
+	conn, notifications, err := dialKodi(s)
+	if err != nil {
+		kodiLogger.Warnln("could not connect to Kodi:", err)
+		return nil
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if _, err := conn.Call("JSONRPC.Ping", nil); err != nil {
+		kodiLogger.Warnln("Kodi doesn't respond:", err)
+		return nil
+	}
+	if notifications {
+		kodiLogger.Printf("connected to Kodi at %s over %s (ping: %s)\n", s.address(), s.transport, time.Since(start))
+	} else {
+		kodiLogger.Printf("connected to Kodi at %s over HTTP (ping: %s)\n", s.httpAddress(), time.Since(start))
+	}
+	return nil
+}
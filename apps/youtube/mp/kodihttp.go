@@ -0,0 +1,148 @@
+package mp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/pdf/kodirpc"
+)
+
+// kodiHTTPConn sends JSON-RPC calls to the Kodi web server. It can't receive
+// notifications.
+type kodiHTTPConn struct {
+	url      string
+	username string
+	password string
+	client   *http.Client
+
+	mutex sync.Mutex
+	seq   uint64
+}
+
+func newKodiHTTPConn(address, username, password string) *kodiHTTPConn {
+	return &kodiHTTPConn{
+		url:      "http://" + address + "/jsonrpc",
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: KODI_OPEN_TIMEOUT},
+	}
+}
+
+func (c *kodiHTTPConn) Call(method string, params interface{}) (interface{}, error) {
+	var res kodiResponse
+	if err := c.post(c.request(method, params), &res); err != nil {
+		return nil, err
+	}
+	if res.Error != nil {
+		return res.Result, res.Error
+	}
+	return res.Result, nil
+}
+
+// CallBatch sends the calls in a single JSON-RPC batch request, see
+// kodiBatcher.
+func (c *kodiHTTPConn) CallBatch(calls []kodiCall) ([]interface{}, []error, error) {
+	requests := make([]kodiRequest, len(calls))
+	for i, call := range calls {
+		requests[i] = c.request(call.method, call.params)
+	}
+	var responses []kodiResponse
+	if err := c.post(requests, &responses); err != nil {
+		return nil, nil, err
+	}
+	results, errs := matchBatch(requests, responses)
+	return results, errs, nil
+}
+
+// request returns a request with a new ID.
+func (c *kodiHTTPConn) request(method string, params interface{}) kodiRequest {
+	c.mutex.Lock()
+	id := c.seq
+	c.seq++
+	c.mutex.Unlock()
+	return kodiRequest{"2.0", method, params, &id}
+}
+
+// post sends a request, or an array of requests, and decodes the response.
+func (c *kodiHTTPConn) post(request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errors.New("kodi: wrong username or password")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("kodi: HTTP status %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// Handle does nothing, as there are no notifications over HTTP.
+func (c *kodiHTTPConn) Handle(method string, handler kodirpc.NotificationHandler) {
+}
+
+func (c *kodiHTTPConn) Close() error {
+	return nil
+}
+
+// kodiRequest and kodiResponse are JSON-RPC messages, for the transports
+// kodirpc doesn't provide.
+type kodiRequest struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+	Id      *uint64     `json:"id,omitempty"`
+}
+
+// matchBatch returns the results and errors of a batch request in the order
+// of the requests: Kodi may answer them in any order.
+func matchBatch(requests []kodiRequest, responses []kodiResponse) ([]interface{}, []error) {
+	byId := make(map[uint64]kodiResponse, len(responses))
+	for _, res := range responses {
+		if res.Id != nil {
+			byId[*res.Id] = res
+		}
+	}
+	results := make([]interface{}, len(requests))
+	errs := make([]error, len(requests))
+	for i, req := range requests {
+		res, ok := byId[*req.Id]
+		switch {
+		case !ok:
+			errs[i] = errors.New("kodi: no response to " + req.Method)
+		case res.Error != nil:
+			results[i], errs[i] = res.Result, res.Error
+		default:
+			results[i] = res.Result
+		}
+	}
+	return results, errs
+}
+
+type kodiResponse struct {
+	Id     *uint64        `json:"id"`
+	Method string         `json:"method"`
+	Params interface{}    `json:"params"`
+	Result interface{}    `json:"result"`
+	Error  *kodirpc.Error `json:"error"`
+}
@@ -0,0 +1,136 @@
+package mp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pdf/kodirpc"
+)
+
+// fakeKodiHTTP answers JSON-RPC requests with the result of result, if it is
+// set and returns one, or otherwise with the method name. It answers with an
+// error for "Fail" or when fail returns one, and records the methods in the
+// order they were executed. When hold is set, Player.GetActivePlayers isn't
+// answered until it is closed.
+type fakeKodiHTTP struct {
+	mutex    sync.Mutex
+	requests int
+	methods  []string
+	hold     chan struct{}
+	fail     func(req kodiRequest) *kodirpc.Error
+	result   func(req kodiRequest) interface{}
+}
+
+func (k *fakeKodiHTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mutex.Lock()
+	k.requests++
+	k.mutex.Unlock()
+
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.HasPrefix(string(body), "[") {
+		var requests []kodiRequest
+		json.Unmarshal(body, &requests)
+		responses := make([]interface{}, len(requests))
+		for i, req := range requests {
+			// Answer in reverse order, which JSON-RPC allows.
+			responses[len(requests)-1-i] = k.answer(req)
+		}
+		json.NewEncoder(w).Encode(responses)
+		return
+	}
+	var req kodiRequest
+	json.Unmarshal(body, &req)
+	json.NewEncoder(w).Encode(k.answer(req))
+}
+
+func (k *fakeKodiHTTP) answer(req kodiRequest) map[string]interface{} {
+	if req.Method == "Player.GetActivePlayers" && k.hold != nil {
+		<-k.hold
+	}
+	k.mutex.Lock()
+	k.methods = append(k.methods, req.Method)
+	k.mutex.Unlock()
+
+	var err *kodirpc.Error
+	if req.Method == "Fail" {
+		err = &kodirpc.Error{Code: -32602, Message: "Invalid params."}
+	} else if k.fail != nil {
+		err = k.fail(req)
+	}
+	var result interface{} = req.Method
+	if err == nil && k.result != nil {
+		if r := k.result(req); r != nil {
+			result = r
+		}
+	}
+	res := map[string]interface{}{"jsonrpc": "2.0", "id": req.Id}
+	if err != nil {
+		res["error"] = err
+	} else {
+		res["result"] = result
+	}
+	return res
+}
+
+func TestKodiHTTPBatch(t *testing.T) {
+	fake := &fakeKodiHTTP{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	conn := newKodiHTTPConn(server.Listener.Addr().String(), "", "")
+	results, errs, err := conn.CallBatch([]kodiCall{
+		{"Application.SetVolume", nil},
+		{"Fail", nil},
+		{"Player.Open", nil},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.requests != 1 {
+		t.Errorf("batch took %d requests", fake.requests)
+	}
+	if strings.Join(fake.methods, ",") != "Application.SetVolume,Fail,Player.Open" {
+		t.Errorf("calls executed as %v", fake.methods)
+	}
+	if results[0] != "Application.SetVolume" || errs[0] != nil {
+		t.Errorf("call 0: %v, %v", results[0], errs[0])
+	}
+	if rpcErr, ok := errs[1].(*kodirpc.Error); !ok || rpcErr.Code != -32602 {
+		t.Errorf("call 1: expected a Kodi error, got %v", errs[1])
+	}
+	if results[2] != "Player.Open" || errs[2] != nil {
+		t.Errorf("call 2: %v, %v", results[2], errs[2])
+	}
+
+	result, err := conn.Call("JSONRPC.Ping", nil)
+	if result != "JSONRPC.Ping" || err != nil {
+		t.Errorf("single call: %v, %v", result, err)
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	fake := &fakeKodiHTTP{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	kodi := &Kodi{lost: make(chan struct{}, 1)}
+	kodi.conn = newKodiHTTPConn(server.Listener.Addr().String(), "", "")
+	results, errs := kodi.sendBatch([]kodiCall{{"A", nil}, {"B", nil}})
+	if results[0] != "A" || results[1] != "B" || errs[0] != nil || errs[1] != nil {
+		t.Errorf("got %v, %v", results, errs)
+	}
+
+	kodi.conn = nil
+	_, errs = kodi.sendBatch([]kodiCall{{"A", nil}, {"B", nil}})
+	if errs[0] != errKodiNotConnected || errs[1] != errKodiNotConnected {
+		t.Errorf("got %v while not connected", errs)
+	}
+}
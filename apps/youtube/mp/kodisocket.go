@@ -0,0 +1,234 @@
+package mp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pdf/kodirpc"
+)
+
+// kodiSocket is the JSON-RPC part of a connection to the notification socket
+// of Kodi, over raw TCP (kodiTCPConn) or a WebSocket (kodiWebSocketConn):
+// requests are sent as messages, and the responses and notifications that
+// come back are routed to the waiting calls and the handlers.
+type kodiSocket struct {
+	mutex    sync.Mutex
+	seq      uint64
+	pending  map[uint64]chan kodiResponse
+	handlers map[string][]kodirpc.NotificationHandler
+	closed   bool
+}
+
+var errKodiSocketClosed = errors.New("kodi: connection closed")
+
+func newKodiSocket() kodiSocket {
+	return kodiSocket{
+		pending:  make(map[uint64]chan kodiResponse),
+		handlers: make(map[string][]kodirpc.NotificationHandler),
+	}
+}
+
+// callBatch sends the calls with write, as a single JSON-RPC batch request,
+// and waits for the responses, see kodiBatcher. A single call is sent as a
+// normal request.
+func (s *kodiSocket) callBatch(calls []kodiCall, write func([]byte) error) ([]interface{}, []error, error) {
+	requests := make([]kodiRequest, len(calls))
+	channels := make([]chan kodiResponse, len(calls))
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil, nil, errKodiSocketClosed
+	}
+	for i, call := range calls {
+		id := s.seq
+		s.seq++
+		requests[i] = kodiRequest{"2.0", call.method, call.params, &id}
+		channels[i] = make(chan kodiResponse, 1)
+		s.pending[id] = channels[i]
+	}
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		for _, req := range requests {
+			delete(s.pending, *req.Id)
+		}
+		s.mutex.Unlock()
+	}()
+
+	var data []byte
+	var err error
+	if len(requests) == 1 {
+		data, err = json.Marshal(requests[0])
+	} else {
+		data, err = json.Marshal(requests)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := write(data); err != nil {
+		return nil, nil, err
+	}
+
+	responses := make([]kodiResponse, 0, len(requests))
+	timeout := time.After(KODI_OPEN_TIMEOUT)
+	for _, ch := range channels {
+		select {
+		case res, ok := <-ch:
+			if !ok {
+				return nil, nil, errKodiSocketClosed
+			}
+			responses = append(responses, res)
+		case <-timeout:
+			return nil, nil, errors.New("kodi: " + requests[0].Method + " timed out")
+		}
+	}
+	results, errs := matchBatch(requests, responses)
+	return results, errs, nil
+}
+
+func (s *kodiSocket) Handle(method string, handler kodirpc.NotificationHandler) {
+	s.mutex.Lock()
+	s.handlers[method] = append(s.handlers[method], handler)
+	s.mutex.Unlock()
+}
+
+// shutdown ends the pending calls, and makes new calls fail. It returns false
+// when the socket was already shut down.
+func (s *kodiSocket) shutdown() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	s.closed = true
+	for id, ch := range s.pending {
+		close(ch)
+		delete(s.pending, id)
+	}
+	return true
+}
+
+func (s *kodiSocket) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+// deliver decodes a message from Kodi and routes it.
+func (s *kodiSocket) deliver(message []byte) {
+	// The response to a batch request is an array.
+	var responses []kodiResponse
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(message), []byte("[")) {
+		err = json.Unmarshal(message, &responses)
+	} else {
+		responses = make([]kodiResponse, 1)
+		err = json.Unmarshal(message, &responses[0])
+	}
+	if err != nil {
+		kodiLogger.Warnln("could not decode message:", err)
+		return
+	}
+	for _, res := range responses {
+		s.process(res)
+	}
+}
+
+// process routes a message to the waiting call or to the notification
+// handlers.
+func (s *kodiSocket) process(res kodiResponse) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if res.Id != nil {
+		if ch, ok := s.pending[*res.Id]; ok {
+			ch <- res
+		}
+		return
+	}
+
+	params, _ := res.Params.(map[string]interface{})
+	for _, handler := range s.handlers[res.Method] {
+		go handler(res.Method, params["data"])
+	}
+}
+
+// kodiTCPConn is a JSON-RPC connection to the raw TCP socket of Kodi, where
+// the messages are JSON values, one after the other. Unlike kodirpc, it can
+// send batch requests.
+type kodiTCPConn struct {
+	kodiSocket
+	conn    net.Conn
+	decoder *json.Decoder
+
+	writeMutex sync.Mutex
+}
+
+func dialKodiTCP(address string) (*kodiTCPConn, error) {
+	conn, err := net.DialTimeout("tcp", address, KODI_CALL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	c := newKodiTCPConn(conn)
+	go c.run()
+	return c, nil
+}
+
+func newKodiTCPConn(conn net.Conn) *kodiTCPConn {
+	return &kodiTCPConn{
+		kodiSocket: newKodiSocket(),
+		conn:       conn,
+		decoder:    json.NewDecoder(bufio.NewReader(conn)),
+	}
+}
+
+func (c *kodiTCPConn) Call(method string, params interface{}) (interface{}, error) {
+	results, errs, err := c.CallBatch([]kodiCall{{method, params}})
+	if err != nil {
+		return nil, err
+	}
+	return results[0], errs[0]
+}
+
+// CallBatch sends the calls in a single JSON-RPC batch request, see
+// kodiBatcher.
+func (c *kodiTCPConn) CallBatch(calls []kodiCall) ([]interface{}, []error, error) {
+	return c.callBatch(calls, c.write)
+}
+
+// Close closes the connection. Closing it again does nothing.
+func (c *kodiTCPConn) Close() error {
+	if !c.shutdown() {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// run reads messages and delivers them, until the connection is closed.
+func (c *kodiTCPConn) run() {
+	for {
+		var message json.RawMessage
+		if err := c.decoder.Decode(&message); err != nil {
+			if !c.isClosed() {
+				kodiLogger.Warnln("tcp:", err)
+				c.Close()
+			}
+			return
+		}
+		c.deliver(message)
+	}
+}
+
+func (c *kodiTCPConn) write(data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(KODI_CALL_TIMEOUT))
+	_, err := c.conn.Write(data)
+	return err
+}
@@ -0,0 +1,119 @@
+package mp
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKodiTCPCall(t *testing.T) {
+	client, server := net.Pipe()
+	c := newKodiTCPConn(client)
+	go c.run()
+	defer c.Close()
+
+	notified := make(chan interface{}, 1)
+	c.Handle("Player.OnPlay", func(method string, data interface{}) {
+		notified <- data
+	})
+
+	// Kodi answers every request, and batches in reverse order. Messages
+	// follow each other without separator, and a notification comes first.
+	go func() {
+		defer server.Close()
+		decoder := json.NewDecoder(server)
+		for {
+			var message json.RawMessage
+			if err := decoder.Decode(&message); err != nil {
+				return
+			}
+			var requests []kodiRequest
+			batch := message[0] == '['
+			if batch {
+				json.Unmarshal(message, &requests)
+			} else {
+				requests = make([]kodiRequest, 1)
+				json.Unmarshal(message, &requests[0])
+			}
+			var responses []map[string]interface{}
+			for i := len(requests) - 1; i >= 0; i-- {
+				responses = append(responses, map[string]interface{}{"jsonrpc": "2.0", "id": requests[i].Id, "result": requests[i].Method})
+			}
+			var data []byte
+			if batch {
+				data, _ = json.Marshal(responses)
+			} else {
+				data, _ = json.Marshal(responses[0])
+			}
+			data = append([]byte(`{"jsonrpc":"2.0","method":"Player.OnPlay","params":{"data":"item"}}`), data...)
+			server.SetWriteDeadline(time.Now().Add(time.Second))
+			if _, err := server.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	result, err := c.Call("JSONRPC.Ping", nil)
+	if err != nil || result != "JSONRPC.Ping" {
+		t.Errorf("got %v, %v", result, err)
+	}
+	select {
+	case data := <-notified:
+		if data != "item" {
+			t.Errorf("notification with %v", data)
+		}
+	case <-time.After(time.Second):
+		t.Error("notification not handled")
+	}
+
+	results, errs, err := c.CallBatch([]kodiCall{{"A", nil}, {"B", nil}, {"C", nil}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, method := range []string{"A", "B", "C"} {
+		if results[i] != method || errs[i] != nil {
+			t.Errorf("call %d: got %v, %v", i, results[i], errs[i])
+		}
+	}
+}
+
+func TestKodiTCPClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := newKodiTCPConn(client)
+	go c.run()
+
+	// Kodi doesn't answer.
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := server.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Call("JSONRPC.Ping", nil)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("pending call succeeded")
+		}
+	case <-time.After(time.Second):
+		t.Error("pending call not ended")
+	}
+	if _, err := c.Call("JSONRPC.Ping", nil); err != errKodiSocketClosed {
+		t.Errorf("call after Close: %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package mp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// kodiWebSocketConn is a JSON-RPC connection to Kodi over a WebSocket. Only
+// the part of the WebSocket protocol (RFC 6455) that Kodi uses is implemented.
+type kodiWebSocketConn struct {
+	kodiSocket
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMutex sync.Mutex
+}
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// Maximum size of a message from Kodi, also when it is fragmented.
+const WEBSOCKET_MAX_MESSAGE = 16 << 20
+
+var errWebSocketTooLarge = errors.New("kodi: websocket message too large")
+
+func dialKodiWebSocket(address string) (*kodiWebSocketConn, error) {
+	conn, err := net.DialTimeout("tcp", address, KODI_CALL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+
+	keyData := make([]byte, 16)
+	if _, err := rand.Read(keyData); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyData)
+
+	req, err := http.NewRequest("GET", "http://"+address+"/jsonrpc", nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	conn.SetDeadline(time.Now().Add(KODI_CALL_TIMEOUT))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	conn.SetDeadline(time.Time{})
+
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	accept := base64.StdEncoding.EncodeToString(hash[:])
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != accept {
+		conn.Close()
+		return nil, errors.New("kodi: websocket handshake failed: " + resp.Status)
+	}
+
+	c := &kodiWebSocketConn{
+		kodiSocket: newKodiSocket(),
+		conn:       conn,
+		reader:     reader,
+	}
+	go c.run()
+	return c, nil
+}
+
+func (c *kodiWebSocketConn) Call(method string, params interface{}) (interface{}, error) {
+	results, errs, err := c.CallBatch([]kodiCall{{method, params}})
+	if err != nil {
+		return nil, err
+	}
+	return results[0], errs[0]
+}
+
+// CallBatch sends the calls in a single JSON-RPC batch request, see
+// kodiBatcher.
+func (c *kodiWebSocketConn) CallBatch(calls []kodiCall) ([]interface{}, []error, error) {
+	return c.callBatch(calls, func(data []byte) error {
+		return c.writeFrame(wsText, data)
+	})
+}
+
+// Close closes the connection. Closing it again does nothing.
+func (c *kodiWebSocketConn) Close() error {
+	if !c.shutdown() {
+		return nil
+	}
+	c.writeFrame(wsClose, nil)
+	return c.conn.Close()
+}
+
+// run reads messages and delivers them, until the connection is closed.
+func (c *kodiWebSocketConn) run() {
+	for {
+		message, err := c.readMessage()
+		if err != nil {
+			if !c.isClosed() {
+				kodiLogger.Warnln("websocket:", err)
+				c.Close()
+			}
+			return
+		}
+		c.deliver(message)
+	}
+}
+
+// readMessage reads a complete text message, answering pings on the way.
+func (c *kodiWebSocketConn) readMessage() ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+		case wsPong:
+		case wsClose:
+			return nil, io.EOF
+		case wsText, wsBinary, wsContinuation:
+			if len(message)+len(payload) > WEBSOCKET_MAX_MESSAGE {
+				return nil, errWebSocketTooLarge
+			}
+			message = append(message, payload...)
+			if fin {
+				return message, nil
+			}
+		}
+	}
+}
+
+func (c *kodiWebSocketConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		data := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(data))
+	case 127:
+		data := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(data)
+	}
+	if length > WEBSOCKET_MAX_MESSAGE {
+		return false, 0, nil, errWebSocketTooLarge
+	}
+
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, mask); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes a single, final frame. Frames from a client must be
+// masked.
+func (c *kodiWebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, 0x80|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+
+	mask := make([]byte, 4)
+	if _, err := rand.Read(mask); err != nil {
+		return err
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err := c.conn.Write(frame)
+	return err
+}
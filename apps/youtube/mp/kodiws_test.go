@@ -0,0 +1,237 @@
+package mp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// recordConn is a net.Conn that records what is written to it.
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+	closed  int
+}
+
+func (c *recordConn) Write(data []byte) (int, error) {
+	return c.written.Write(data)
+}
+
+func (c *recordConn) Close() error {
+	c.closed++
+	return nil
+}
+
+// serverFrame returns a frame as sent by Kodi, which isn't masked.
+func serverFrame(fin bool, opcode byte, payload []byte) []byte {
+	frame := []byte{opcode}
+	if fin {
+		frame[0] |= 0x80
+	}
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xffff:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+	return append(frame, payload...)
+}
+
+// newTestWebSocket returns a connection that reads the given frames, and
+// records what it writes.
+func newTestWebSocket(frames ...[]byte) (*kodiWebSocketConn, *recordConn) {
+	conn := &recordConn{}
+	return &kodiWebSocketConn{
+		kodiSocket: newKodiSocket(),
+		conn:       conn,
+		reader:     bufio.NewReader(bytes.NewReader(bytes.Join(frames, nil))),
+	}, conn
+}
+
+func TestWebSocketFrameRoundTrip(t *testing.T) {
+	for _, length := range []int{0, 1, 125, 126, 127, 0xffff, 0x10000, 100000} {
+		payload := make([]byte, length)
+		for i := range payload {
+			payload[i] = byte(i%251) + 1
+		}
+
+		c, conn := newTestWebSocket()
+		if err := c.writeFrame(wsText, payload); err != nil {
+			t.Fatal(err)
+		}
+		raw := conn.written.Bytes()
+		if raw[0] != 0x80|wsText {
+			t.Errorf("length %d: got first byte %#x", length, raw[0])
+		}
+		if raw[1]&0x80 == 0 {
+			t.Errorf("length %d: frame from the client isn't masked", length)
+		}
+		if length >= 16 && bytes.Contains(raw, payload) {
+			t.Errorf("length %d: payload isn't masked", length)
+		}
+
+		reader := &kodiWebSocketConn{reader: bufio.NewReader(bytes.NewReader(raw))}
+		fin, opcode, got, err := reader.readFrame()
+		if err != nil {
+			t.Fatalf("length %d: %s", length, err)
+		}
+		if !fin || opcode != wsText || !bytes.Equal(got, payload) {
+			t.Errorf("length %d: frame changed in round trip (fin %t, opcode %d, %d bytes)", length, fin, opcode, len(got))
+		}
+
+		// Frames from Kodi aren't masked.
+		reader = &kodiWebSocketConn{reader: bufio.NewReader(bytes.NewReader(serverFrame(true, wsBinary, payload)))}
+		fin, opcode, got, err = reader.readFrame()
+		if err != nil || !fin || opcode != wsBinary || !bytes.Equal(got, payload) {
+			t.Errorf("length %d: could not read unmasked frame: %v", length, err)
+		}
+	}
+}
+
+func TestWebSocketFragmentation(t *testing.T) {
+	c, conn := newTestWebSocket(
+		serverFrame(false, wsText, []byte(`{"jsonrpc":`)),
+		serverFrame(true, wsPing, []byte("ping")),
+		serverFrame(false, wsContinuation, []byte(`"2.0",`)),
+		serverFrame(true, wsPong, nil),
+		serverFrame(true, wsContinuation, []byte(`"id":1}`)),
+		serverFrame(true, wsClose, nil),
+	)
+	message, err := c.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message) != `{"jsonrpc":"2.0","id":1}` {
+		t.Errorf("got message %s", message)
+	}
+
+	// The ping must have been answered with a pong with the same payload.
+	reader := &kodiWebSocketConn{reader: bufio.NewReader(bytes.NewReader(conn.written.Bytes()))}
+	fin, opcode, payload, err := reader.readFrame()
+	if err != nil || !fin || opcode != wsPong || string(payload) != "ping" {
+		t.Errorf("no pong: %v %d %q", err, opcode, payload)
+	}
+
+	if _, err := c.readMessage(); err != io.EOF {
+		t.Errorf("expected io.EOF after a close frame, got %v", err)
+	}
+}
+
+func TestWebSocketTooLarge(t *testing.T) {
+	header := []byte{0x80 | wsText, 127, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(header[2:], WEBSOCKET_MAX_MESSAGE+1)
+	c, _ := newTestWebSocket(header)
+	if _, err := c.readMessage(); err != errWebSocketTooLarge {
+		t.Errorf("expected errWebSocketTooLarge, got %v", err)
+	}
+
+	header = []byte{0x80 | wsText, 127, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	c, _ = newTestWebSocket(header)
+	if _, err := c.readMessage(); err != errWebSocketTooLarge {
+		t.Errorf("expected errWebSocketTooLarge for a huge length, got %v", err)
+	}
+
+	// Fragments that are too large together.
+	fragment := make([]byte, WEBSOCKET_MAX_MESSAGE/2+1)
+	c, _ = newTestWebSocket(serverFrame(false, wsText, fragment), serverFrame(true, wsContinuation, fragment))
+	if _, err := c.readMessage(); err != errWebSocketTooLarge {
+		t.Errorf("expected errWebSocketTooLarge for fragments, got %v", err)
+	}
+
+	// A truncated frame.
+	c, _ = newTestWebSocket(serverFrame(true, wsText, []byte("abc"))[:3])
+	if _, err := c.readMessage(); err == nil {
+		t.Error("expected an error for a truncated frame")
+	}
+}
+
+func TestWebSocketClose(t *testing.T) {
+	c, conn := newTestWebSocket()
+	ch := make(chan kodiResponse, 1)
+	c.pending[1] = ch
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	if conn.closed != 1 {
+		t.Errorf("connection closed %d times", conn.closed)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("pending call not ended")
+	}
+	if _, err := c.Call("JSONRPC.Ping", nil); err != errKodiSocketClosed {
+		t.Errorf("call after Close: %v", err)
+	}
+}
+
+func TestWebSocketCall(t *testing.T) {
+	client, server := net.Pipe()
+	c := &kodiWebSocketConn{
+		kodiSocket: newKodiSocket(),
+		conn:       client,
+		reader:     bufio.NewReader(client),
+	}
+	go c.run()
+	defer c.Close()
+
+	// Kodi answers every request, and batches in reverse order.
+	go func() {
+		defer server.Close()
+		kodi := &kodiWebSocketConn{reader: bufio.NewReader(server)}
+		for {
+			_, opcode, payload, err := kodi.readFrame()
+			if err != nil || opcode == wsClose {
+				return
+			}
+			var requests []kodiRequest
+			batch := payload[0] == '['
+			if batch {
+				json.Unmarshal(payload, &requests)
+			} else {
+				requests = make([]kodiRequest, 1)
+				json.Unmarshal(payload, &requests[0])
+			}
+			var responses []map[string]interface{}
+			for i := len(requests) - 1; i >= 0; i-- {
+				responses = append(responses, map[string]interface{}{"jsonrpc": "2.0", "id": requests[i].Id, "result": requests[i].Method})
+			}
+			var data []byte
+			if batch {
+				data, _ = json.Marshal(responses)
+			} else {
+				data, _ = json.Marshal(responses[0])
+			}
+			server.SetWriteDeadline(time.Now().Add(time.Second))
+			if _, err := server.Write(serverFrame(true, wsText, data)); err != nil {
+				return
+			}
+		}
+	}()
+
+	result, err := c.Call("JSONRPC.Ping", nil)
+	if err != nil || result != "JSONRPC.Ping" {
+		t.Errorf("got %v, %v", result, err)
+	}
+
+	results, errs, err := c.CallBatch([]kodiCall{{"A", nil}, {"B", nil}, {"C", nil}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, method := range []string{"A", "B", "C"} {
+		if results[i] != method || errs[i] != nil {
+			t.Errorf("call %d: got %v, %v", i, results[i], errs[i])
+		}
+	}
+}
@@ -5,6 +5,7 @@ package mp
 import (
 	"errors"
 	"flag"
+	"strings"
 	"time"
 
 	"github.com/sargo/kodicast/log"
@@ -19,9 +20,9 @@ type State int
 
 const (
 	STATE_STOPPED   State = 0
-	STATE_PLAYING         = 1
-	STATE_PAUSED          = 2
-	STATE_BUFFERING       = 3
+	STATE_PLAYING   State = 1
+	STATE_PAUSED    State = 2
+	STATE_BUFFERING State = 3
 )
 
 // PlayState defines the current state of the generic MediaPlayer.
@@ -35,10 +36,37 @@ type PlayState struct {
 	State             State
 	ListId            string
 	Volume            int
+	Muted             bool
+	Rate              float64 // playback speed, 1 is normal
+	Repeat            RepeatMode
+	Shuffle           bool
+	shuffleOrder      []string      // video IDs in the order they're played with shuffle
+	duration          time.Duration // duration of the current video, 0 when unknown
+	live              bool          // the current video is a live stream
+	timeline          timeline      // position of the current video while playing or paused
+	Autoplay          bool          // play an up next video when the queue is finished
+	stopPolicy        StopPolicy    // what to do when the user stops a video on the media player
+	subtitleSet       bool          // true when a remote has chosen a subtitle language
+	subtitleLanguage  string        // subtitle language chosen by a remote, empty for off
+	subtitlePending   string        // video for which the subtitle language isn't available (yet)
+	subtitle          Subtitle      // subtitle track currently shown, reported to remotes
+	audioLanguages    []string      // preferred audio languages, most preferred first
+	audioVideo        string        // video for which the audio stream has been chosen
+	upNext            string        // video to play after the queue, if autoplay is enabled
+	upNextAfter       string        // video upNext was chosen for
 	bufferingPosition time.Duration
-	newVolume         bool  // true if the Volume property must be reapplied to the player
-	previousState     State // state before current state
-	nextState         State // state after buffering
+	startPosition     time.Duration // position to seek to when the video starts playing
+	resuming          bool          // the current video may already be playing, see ResumePlaystate
+	pendingVideo      string        // video to start when the media player connects, see playVideo
+	pendingPosition   time.Duration // position to start the pending video at
+	newVolume         bool          // true if the Volume and Muted properties must be reapplied to the player
+	newRate           bool          // true if the Rate must be reapplied to the player
+	speed             float64       // speed last reported by the media player, 0 when unknown, see handleSpeed
+	volumeChanged     time.Time     // when the volume was last changed by a remote
+	reportedQueue     QueueChange   // the queue as last sent in a QueueChange
+	stateReported     time.Time     // when the state was last sent to stateChange
+	previousState     State         // state before current state
+	nextState         State         // state after buffering
 }
 
 // Video returns the current video, or an empty string if there is no current
@@ -67,13 +95,218 @@ type PlaylistState struct {
 	Position time.Duration
 	State    State
 	ListId   string
+	Duration time.Duration // 0 when unknown; for live videos, the seekable range
+	Live     bool
 }
 
 type StateChange struct {
 	State    State
 	Position time.Duration
+	Duration time.Duration // 0 when unknown; for live videos, the seekable range
+	Live     bool
 }
 
+// Progress is the position within the current video. For live videos, the
+// position is relative to the start of the seekable range, which ends at
+// Duration (the live edge).
+type Progress struct {
+	Position time.Duration
+	Duration time.Duration // 0 when unknown
+	Live     bool
+}
+
+// Subtitle is a subtitle track of the current video. The zero value means no
+// subtitles are shown.
+type Subtitle struct {
+	Index    int
+	Language string // two-letter code when known, see normalizeLanguage
+	Name     string
+}
+
+// AudioStream is an audio stream of the current video.
+type AudioStream struct {
+	Index    int
+	Language string // two-letter code when known, see normalizeLanguage
+	Name     string
+}
+
+// SubtitleState describes the subtitles of the current video.
+type SubtitleState struct {
+	Enabled   bool
+	Current   Subtitle
+	Available []Subtitle
+}
+
+// Event is sent over the events channel of the MediaPlayer for things that
+// happen besides state changes. It is one of the event types below.
+type Event interface{}
+
+// PlayError is sent when a video could not be started.
+type PlayError struct {
+	VideoId string
+	Err     error
+}
+
+// SubtitlesChange is sent when the subtitle track has changed, either by a
+// remote or on the media player itself, and when it is requested.
+type SubtitlesChange struct {
+	VideoId  string
+	Subtitle Subtitle
+}
+
+// PlaylistModeChange is sent when the repeat or shuffle mode has changed,
+// and when it is requested.
+type PlaylistModeChange struct {
+	Repeat  RepeatMode
+	Shuffle bool
+}
+
+// RateChange is sent when the playback speed has changed, and when it is
+// requested.
+type RateChange struct {
+	Rate float64
+}
+
+// QueueChange is sent when the queue or the current video has changed.
+type QueueChange struct {
+	Playlist    []string
+	Index       int
+	ListId      string
+	HasPrevious bool
+	HasNext     bool
+}
+
+// VolumeChange is sent when the volume or mute state has changed, either by a
+// remote or on the media player itself, and when it is requested.
+type VolumeChange struct {
+	Volume int
+	Muted  bool
+}
+
+// AutoplayModeChange is sent when autoplay has been enabled or disabled, and
+// when the mode is requested.
+type AutoplayModeChange struct {
+	Supported bool // false when there is no NextVideoProvider
+	Enabled   bool
+}
+
+// AutoplayUpNext is sent when the video to play after the queue is known. The
+// VideoId is empty when there is no such video anymore.
+type AutoplayUpNext struct {
+	VideoId string
+}
+
+// Volume until the volume of the media player is known.
 const INITIAL_VOLUME = 80
 
+// Range of playback speeds that may be set.
+const (
+	MIN_RATE = 0.25
+	MAX_RATE = 4
+)
+
+// A video that starts within this time from the requested start position
+// isn't seeked again.
+const START_POSITION_MARGIN = 2 * time.Second
+
+// A seek to less than this time before the live edge of a live video is a
+// seek to the live edge.
+const LIVE_EDGE_MARGIN = 5 * time.Second
+
+// Volume changes on the media player are ignored for this time after a
+// remote has changed the volume, as they're probably caused by that change.
+const VOLUME_EVENT_DELAY = time.Second
+
+// Interval at which properties are polled that the media player doesn't send
+// events for.
+const POLL_INTERVAL = 5 * time.Second
+
 var PROPERTY_UNAVAILABLE = errors.New("media player: property unavailable")
+
+// Key is a key on a remote control, as sent by the remote mode of YouTube
+// remotes. Android key codes ("KEYCODE_DPAD_UP") are converted by ParseKey.
+type Key string
+
+const (
+	KEY_UP          Key = "UP"
+	KEY_DOWN        Key = "DOWN"
+	KEY_LEFT        Key = "LEFT"
+	KEY_RIGHT       Key = "RIGHT"
+	KEY_ENTER       Key = "ENTER"
+	KEY_BACK        Key = "BACK"
+	KEY_HOME        Key = "HOME"
+	KEY_MENU        Key = "MENU"
+	KEY_INFO        Key = "INFO"
+	KEY_PLAY_PAUSE  Key = "PLAY_PAUSE"
+	KEY_STOP        Key = "STOP"
+	KEY_FAST_FWD    Key = "FAST_FORWARD"
+	KEY_REWIND      Key = "REWIND"
+	KEY_VOLUME_UP   Key = "VOLUME_UP"
+	KEY_VOLUME_DOWN Key = "VOLUME_DOWN"
+	KEY_MUTE        Key = "VOLUME_MUTE"
+	KEY_SUBTITLES   Key = "CAPTIONS"
+)
+
+// Other names that are used for the same keys.
+var keyAliases = map[string]Key{
+	"CENTER":             KEY_ENTER,
+	"SELECT":             KEY_ENTER,
+	"OK":                 KEY_ENTER,
+	"ESCAPE":             KEY_BACK,
+	"MEDIA_PLAY_PAUSE":   KEY_PLAY_PAUSE,
+	"MEDIA_STOP":         KEY_STOP,
+	"MEDIA_FAST_FORWARD": KEY_FAST_FWD,
+	"MEDIA_REWIND":       KEY_REWIND,
+	"MUTE":               KEY_MUTE,
+	"SUBTITLES":          KEY_SUBTITLES,
+}
+
+// ParseKey converts a key name as sent by a remote.
+func ParseKey(name string) Key {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	name = strings.TrimPrefix(name, "KEYCODE_")
+	name = strings.TrimPrefix(name, "DPAD_")
+	if key, ok := keyAliases[name]; ok {
+		return key
+	}
+	return Key(name)
+}
+
+var ErrUnsupportedKey = errors.New("media player: unsupported key")
+
+// ErrUnsupportedRate is returned when the media player can't play at a
+// playback speed. The speed isn't changed then.
+var ErrUnsupportedRate = errors.New("media player: unsupported playback speed")
+
+// StopPolicy is what happens when the user stops a video on the media player
+// itself (for example, with the stop button of the Kodi remote).
+type StopPolicy int
+
+const (
+	STOP_QUIT StopPolicy = iota // end the session
+	STOP_KEEP                   // keep the session, the video is stopped
+	STOP_NEXT                   // play the next video
+)
+
+func (sp StopPolicy) String() string {
+	switch sp {
+	case STOP_QUIT:
+		return "quit"
+	case STOP_KEEP:
+		return "keep"
+	case STOP_NEXT:
+		return "next"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseStopPolicy converts the string form of a StopPolicy.
+func ParseStopPolicy(s string) (StopPolicy, bool) {
+	for _, policy := range []StopPolicy{STOP_QUIT, STOP_KEEP, STOP_NEXT} {
+		if s == policy.String() {
+			return policy, true
+		}
+	}
+	return STOP_QUIT, false
+}
@@ -1,6 +1,8 @@
 package mp
 
 import (
+	"errors"
+	"math"
 	"time"
 )
 
@@ -8,31 +10,43 @@ import (
 type MediaPlayer struct {
 	player      Backend
 	stateChange chan StateChange
+	events      chan Event
+	provider    NextVideoProvider // nil when autoplay isn't supported
 
 	// A channel to coordinate access to the PlayState.
 	// The pointer to the PlayState is used as an access token.
 	playstateChan chan PlayState
+
+	// Closed by Quit, so the main loop stops serving the PlayState.
+	quit chan struct{}
 }
 
-func New(stateChange chan StateChange) *MediaPlayer {
+// New starts a new MediaPlayer. keepVideo is the video of a session that is
+// going to be resumed, or an empty string: when the media player is still
+// playing it, it isn't stopped on startup (see ResumePlaystate).
+func New(stateChange chan StateChange, events chan Event, provider NextVideoProvider, autoplay bool, keepVideo string) *MediaPlayer {
 	p := MediaPlayer{}
 	p.stateChange = stateChange
+	p.events = events
+	p.provider = provider
 	p.playstateChan = make(chan PlayState)
+	p.quit = make(chan struct{})
 
-	p.player = &Kodi{}
+	p.player = &Kodi{keepVideo: keepVideo}
 	playerEventChan := p.player.initialize()
 
-	go p.run(playerEventChan, 100)
+	go p.run(playerEventChan, INITIAL_VOLUME, autoplay && provider != nil)
 
 	return &p
 }
 
 // Quit quits the MediaPlayer.
-// No other method may be called upon this object after this function has been
-// called.
+// Other methods may still be called after this function has been called, but
+// they won't do anything.
 func (p *MediaPlayer) Quit() {
 	p.getPlayState(func(ps *PlayState) {
 		p.player.quit()
+		close(p.quit)
 	})
 }
 
@@ -45,7 +59,16 @@ func (p *MediaPlayer) getPosition(ps *PlayState) time.Duration {
 	case STATE_BUFFERING:
 		position = ps.bufferingPosition
 	case STATE_PLAYING, STATE_PAUSED:
-		position = p.player.getPosition()
+		if ps.timeline.valid {
+			duration := ps.duration
+			if ps.live {
+				// The live edge moves along.
+				duration = 0
+			}
+			position = ps.timeline.position(duration)
+		} else {
+			position = p.refreshProgress(ps)
+		}
 	default:
 		panic("unknown state")
 	}
@@ -57,6 +80,56 @@ func (p *MediaPlayer) getPosition(ps *PlayState) time.Duration {
 	return position
 }
 
+// refreshProgress gets the position of the playing video from the media
+// player, and updates the timeline, duration and live flag on the way.
+func (p *MediaPlayer) refreshProgress(ps *PlayState) time.Duration {
+	progress, err := p.player.getProgress()
+	if err != nil {
+		return p.player.getPosition()
+	}
+	return p.setProgress(ps, progress)
+}
+
+// setProgress updates the timeline, duration and live flag with the progress
+// read from the media player, and returns the position.
+func (p *MediaPlayer) setProgress(ps *PlayState, progress Progress) time.Duration {
+	ps.duration = progress.Duration
+	ps.live = progress.Live
+	if progress.Position < 0 {
+		progress.Position = 0
+	}
+	p.anchorTimeline(ps, progress.Position)
+	return progress.Position
+}
+
+// anchorTimeline sets the position of the timeline, which advances with the
+// playback speed while playing.
+func (p *MediaPlayer) anchorTimeline(ps *PlayState, position time.Duration) {
+	rate := 0.0
+	if ps.State == STATE_PLAYING {
+		rate = ps.Rate
+	}
+	ps.timeline.set(position, rate)
+}
+
+// resyncTimeline compares the timeline with the media player. Remotes get the
+// new position when the timeline had drifted, and otherwise every
+// HEARTBEAT_INTERVAL while playing.
+func (p *MediaPlayer) resyncTimeline(ps *PlayState) {
+	if !ps.timeline.valid {
+		p.reportState(ps, p.refreshProgress(ps))
+		return
+	}
+	expected := p.getPosition(ps)
+	position := p.refreshProgress(ps)
+	if drift := position - expected; drift > TIMELINE_MAX_DRIFT || drift < -TIMELINE_MAX_DRIFT {
+		logger.Println("timeline drifted by", drift)
+		p.reportState(ps, position)
+	} else if ps.State == STATE_PLAYING && time.Since(ps.stateReported) >= HEARTBEAT_INTERVAL {
+		p.reportState(ps, position)
+	}
+}
+
 // getPlayState gets the play state for use in a callback.
 // The *PlayState argument may only be used until the callback exits to prevent
 // race conditions.
@@ -82,6 +155,9 @@ func (p *MediaPlayer) SetPlaystate(playlist []string, index int, position time.D
 		ps.Playlist = playlist
 		ps.Index = index
 		ps.ListId = listId
+		if ps.Shuffle {
+			ps.shuffleOrder = newShuffleOrder(playlist, index)
+		}
 
 		if len(ps.Playlist) > 0 {
 			p.startPlaying(ps, position)
@@ -91,6 +167,21 @@ func (p *MediaPlayer) SetPlaystate(playlist []string, index int, position time.D
 	})
 }
 
+// ResumePlaystate is like SetPlaystate, but for resuming a session. When the
+// media player is still playing the current video, it isn't started again.
+func (p *MediaPlayer) ResumePlaystate(playlist []string, index int, position time.Duration, listId string) {
+	p.getPlayState(func(ps *PlayState) {
+		ps.Playlist = playlist
+		ps.Index = index
+		ps.ListId = listId
+		if ps.Shuffle {
+			ps.shuffleOrder = newShuffleOrder(playlist, index)
+		}
+		p.startPlaying(ps, position)
+		ps.resuming = true
+	})
+}
+
 func (p *MediaPlayer) startPlaying(ps *PlayState, position time.Duration) {
 	if ps.State == STATE_PLAYING {
 		// Pause the currently playing track.
@@ -103,7 +194,18 @@ func (p *MediaPlayer) startPlaying(ps *PlayState, position time.Duration) {
 		//     playing video.
 		p.player.pause()
 	}
+	ps.duration = 0
+	ps.live = false
 	p.setPlayState(ps, STATE_BUFFERING, position)
+	ps.subtitle = Subtitle{}
+	ps.audioVideo = ""
+	ps.resuming = false
+	ps.pendingVideo = ""
+	// Kodi resets the speed for every video.
+	ps.speed = 0
+	if ps.Rate != 1 {
+		ps.newRate = true
+	}
 
 	videoId := ps.Playlist[ps.Index]
 
@@ -122,22 +224,92 @@ func (p *MediaPlayer) startPlaying(ps *PlayState, position time.Duration) {
 				// stale video
 				return
 			}
-
-			volume := -1
-			if ps.newVolume {
-				ps.newVolume = false
-				volume = ps.Volume
-			}
-
-			p.player.play(videoId, position, volume)
+			p.playVideo(ps, position)
 		})
 	}()
 }
 
+// playVideo starts the current video on the media player. When the media
+// player isn't connected (yet), the video stays buffering and is started when
+// it connects, see handleConnected.
+func (p *MediaPlayer) playVideo(ps *PlayState, position time.Duration) {
+	videoId := ps.Video()
+	if ps.resuming && p.adoptVideo(ps) {
+		return
+	}
+
+	volume := -1
+	if ps.newVolume {
+		ps.newVolume = false
+		volume = ps.Volume
+		ps.volumeChanged = time.Now()
+	}
+
+	ps.startPosition = position
+	err := p.player.play(videoId, position, volume, ps.Muted)
+	if err == errKodiNotConnected {
+		logger.Println("not connected, video is started later:", videoId)
+		ps.pendingVideo = videoId
+		ps.pendingPosition = position
+		if volume >= 0 {
+			ps.newVolume = true
+		}
+		return
+	}
+	if err != nil {
+		logger.Warnf("could not play video %s: %s\n", videoId, err)
+		p.setPlayState(ps, STATE_STOPPED, 0)
+		p.events <- PlayError{videoId, err}
+	}
+}
+
+// adoptVideo continues with the current video when the media player is already
+// playing it, instead of starting it again. It returns false when it isn't
+// playing.
+func (p *MediaPlayer) adoptVideo(ps *PlayState) bool {
+	video, paused, err := p.player.playing()
+	if err == errKodiNotConnected {
+		// Checked again when connected.
+		return false
+	}
+	ps.resuming = false
+	if err != nil || video != ps.Video() {
+		return false
+	}
+	logger.Println("video is still playing:", video)
+	if paused {
+		ps.bufferingPosition = -1
+		p.setPlayState(ps, STATE_PAUSED, -1)
+	} else {
+		p.handleState(ps, STATE_PLAYING)
+	}
+	return true
+}
+
+// videoEnded is called when the current video has finished playing.
+func (p *MediaPlayer) videoEnded(ps *PlayState) {
+	if ps.Repeat == REPEAT_ONE && len(ps.Playlist) > 0 {
+		p.startPlaying(ps, 0)
+		return
+	}
+	// There may be more videos.
+	p.nextVideo(ps)
+}
+
 func (p *MediaPlayer) nextVideo(ps *PlayState) {
-	if ps.Index+1 < len(ps.Playlist) {
+	if index, ok := nextIndex(ps); ok {
 		// there are more videos, play the next
-		ps.Index++
+		ps.Index = index
+		p.startPlaying(ps, 0)
+	} else if upNext := p.upNext(ps); upNext != "" {
+		// the queue has finished, continue with the autoplay video
+		ps.Playlist = append(append([]string{}, ps.Playlist...), upNext)
+		ps.Index = len(ps.Playlist) - 1
+		if ps.Shuffle {
+			ps.shuffleOrder = append(ps.shuffleOrder, upNext)
+		}
+		ps.upNext = ""
+		p.events <- AutoplayUpNext{""}
 		p.startPlaying(ps, 0)
 	} else {
 		// signal that the video has stopped playing
@@ -147,31 +319,155 @@ func (p *MediaPlayer) nextVideo(ps *PlayState) {
 	}
 }
 
+// upNext returns the video to play after the queue, if it is still valid.
+func (p *MediaPlayer) upNext(ps *PlayState) string {
+	if _, ok := nextIndex(ps); ok || !ps.Autoplay || ps.upNextAfter != ps.Video() {
+		return ""
+	}
+	return ps.upNext
+}
+
+// prepareUpNext asks the NextVideoProvider for a video to play after the
+// queue, when the last video of the queue is playing.
+func (p *MediaPlayer) prepareUpNext(ps *PlayState) {
+	videoId := ps.Video()
+	if !ps.Autoplay || p.provider == nil || videoId == "" || ps.upNextAfter == videoId {
+		return
+	}
+	if _, ok := nextIndex(ps); ok {
+		return
+	}
+	ps.upNextAfter = videoId
+	ps.upNext = ""
+
+	go func() {
+		// The provider may be slow, so it is called without holding the
+		// PlayState.
+		upNext, err := p.provider.NextVideo(videoId)
+		if err != nil {
+			logger.Warnln("could not get autoplay video:", err)
+			return
+		}
+
+		p.getPlayState(func(ps *PlayState) {
+			if ps.upNextAfter != videoId {
+				// stale
+				return
+			}
+			ps.upNext = upNext
+			if p.upNext(ps) != "" {
+				p.events <- AutoplayUpNext{upNext}
+			}
+		})
+	}()
+}
+
+// SetAutoplay enables or disables autoplay.
+func (p *MediaPlayer) SetAutoplay(enabled bool) {
+	p.getPlayState(func(ps *PlayState) {
+		ps.Autoplay = enabled && p.provider != nil
+		if ps.Autoplay {
+			ps.upNextAfter = ""
+			if ps.State == STATE_PLAYING || ps.State == STATE_PAUSED {
+				p.prepareUpNext(ps)
+			}
+		} else if ps.upNext != "" {
+			ps.upNext = ""
+			p.events <- AutoplayUpNext{""}
+		}
+		p.events <- AutoplayModeChange{p.provider != nil, ps.Autoplay}
+	})
+}
+
+// RequestAutoplayMode asynchronously sends the autoplay mode as an
+// AutoplayModeChange event.
+func (p *MediaPlayer) RequestAutoplayMode() {
+	go p.getPlayState(func(ps *PlayState) {
+		p.events <- AutoplayModeChange{p.provider != nil, ps.Autoplay}
+	})
+}
+
+// NextVideo plays the next video, when there is one.
 func (p *MediaPlayer) NextVideo() {
 	p.getPlayState(func(ps *PlayState) {
+		if !p.hasNext(ps) {
+			// The remote should know, see QueueChange.
+			logger.Println("no next video - ignoring")
+			return
+		}
 		p.nextVideo(ps)
 	})
 }
 
+// hasNext returns true when there is a video after the current video.
+func (p *MediaPlayer) hasNext(ps *PlayState) bool {
+	_, ok := nextIndex(ps)
+	return ok || p.upNext(ps) != ""
+}
+
+// hasPrevious returns true when there is a video before the current video.
+func (p *MediaPlayer) hasPrevious(ps *PlayState) bool {
+	_, ok := previousIndex(ps)
+	return ok
+}
+
 func (p *MediaPlayer) previousVideo(ps *PlayState) {
-	if ps.Index-1 >= 0 {
+	if index, ok := previousIndex(ps); ok {
 		// there are more videos, play the previous
-		ps.Index--
+		ps.Index = index
+		p.startPlaying(ps, 0)
+	} else if ps.State == STATE_PLAYING || ps.State == STATE_PAUSED {
+		// this is the first video, start it again
+		p.player.setPosition(0)
+	} else if len(ps.Playlist) > 0 && ps.State == STATE_STOPPED {
 		p.startPlaying(ps, 0)
-	} else {
-		// signal that the video has stopped playing
-		// this resets the position but keeps the playlist
-		// TODO keep the position at the end, not the beginning
-		p.setPlayState(ps, STATE_STOPPED, 0)
 	}
 }
 
+// PreviousVideo plays the previous video, or starts the first video again.
 func (p *MediaPlayer) PreviousVideo() {
 	p.getPlayState(func(ps *PlayState) {
 		p.previousVideo(ps)
 	})
 }
 
+// RequestQueue asynchronously sends the queue as a QueueChange event.
+func (p *MediaPlayer) RequestQueue() {
+	go p.getPlayState(func(ps *PlayState) {
+		p.events <- p.queueState(ps)
+	})
+}
+
+func (p *MediaPlayer) queueState(ps *PlayState) QueueChange {
+	playlist := make([]string, len(ps.Playlist))
+	copy(playlist, ps.Playlist)
+	return QueueChange{playlist, ps.Index, ps.ListId, p.hasPrevious(ps), p.hasNext(ps)}
+}
+
+// checkQueue sends a QueueChange event when the queue, the current video or
+// the availability of a previous or next video has changed.
+func (p *MediaPlayer) checkQueue(ps *PlayState) {
+	queue := p.queueState(ps)
+	last := ps.reportedQueue
+	if queue.Index == last.Index && queue.ListId == last.ListId && queue.HasPrevious == last.HasPrevious && queue.HasNext == last.HasNext && equalPlaylists(queue.Playlist, last.Playlist) {
+		return
+	}
+	ps.reportedQueue = queue
+	p.events <- queue
+}
+
+func equalPlaylists(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // setPlayState updates the PlayState and sends events.
 // position may be -1: in that case it will be updated.
 func (p *MediaPlayer) setPlayState(ps *PlayState, state State, position time.Duration) {
@@ -188,11 +484,26 @@ func (p *MediaPlayer) setPlayState(ps *PlayState, state State, position time.Dur
 		ps.bufferingPosition = -1
 	}
 
-	if position == -1 {
-		position = p.getPosition(ps)
+	if state == STATE_PLAYING || state == STATE_PAUSED {
+		if position == -1 {
+			position = p.getPosition(ps)
+		} else if !ps.timeline.valid {
+			p.refreshProgress(ps)
+		}
+	} else {
+		ps.timeline.invalidate()
+		if position == -1 {
+			position = p.getPosition(ps)
+		}
 	}
 
-	p.stateChange <- StateChange{state, position}
+	p.reportState(ps, position)
+}
+
+// reportState sends the current state with the position to stateChange.
+func (p *MediaPlayer) reportState(ps *PlayState, position time.Duration) {
+	ps.stateReported = time.Now()
+	p.stateChange <- StateChange{ps.State, position, ps.duration, ps.live}
 }
 
 func (p *MediaPlayer) UpdatePlaylist(playlist []string, listId string) {
@@ -203,6 +514,9 @@ func (p *MediaPlayer) UpdatePlaylist(playlist []string, listId string) {
 }
 
 func (p *MediaPlayer) updatePlaylist(ps *PlayState, playlist []string) {
+	if ps.Shuffle {
+		ps.shuffleOrder = updateShuffleOrder(ps.shuffleOrder, playlist, ps.Video())
+	}
 	if len(ps.Playlist) == 0 {
 
 		if ps.State == STATE_PLAYING {
@@ -278,10 +592,23 @@ func (p *MediaPlayer) RequestPlaylist(playlistChan chan PlaylistState) {
 		case <-playlistChan:
 		default:
 		}
-		playlistChan <- PlaylistState{playlist, ps.Index, p.getPosition(ps), ps.State, ps.ListId}
+		playlistChan <- PlaylistState{playlist, ps.Index, p.getPosition(ps), ps.State, ps.ListId, ps.duration, ps.live}
 	})
 }
 
+// GetPlaylist returns the current playlist state. Unlike RequestPlaylist, it
+// blocks until the state is available. It returns an empty state when the
+// player has quit.
+func (p *MediaPlayer) GetPlaylist() PlaylistState {
+	var state PlaylistState
+	p.getPlayState(func(ps *PlayState) {
+		playlist := make([]string, len(ps.Playlist))
+		copy(playlist, ps.Playlist)
+		state = PlaylistState{playlist, ps.Index, p.getPosition(ps), ps.State, ps.ListId, ps.duration, ps.live}
+	})
+	return state
+}
+
 // Pause pauses the currently playing video
 func (p *MediaPlayer) Pause() {
 	p.getPlayState(func(ps *PlayState) {
@@ -289,8 +616,8 @@ func (p *MediaPlayer) Pause() {
 			// This is a Printf and not a Warnf because this occurs often in
 			// practice when seeking and is harmless in that case.
 			logger.Printf("pause while in state %d - ignoring\n", ps.State)
-		} else {
-			p.player.pause()
+		} else if err := p.player.pause(); err != nil {
+			logger.Warnln("could not pause:", err)
 		}
 	})
 }
@@ -309,8 +636,8 @@ func (p *MediaPlayer) Play() {
 		} else {
 			if ps.State != STATE_PAUSED {
 				logger.Warnf("resume while in state %d - ignoring\n", ps.State)
-			} else {
-				p.player.resume()
+			} else if err := p.player.resume(); err != nil {
+				logger.Warnln("could not resume:", err)
 			}
 		}
 	})
@@ -322,7 +649,17 @@ func (p *MediaPlayer) Seek(position time.Duration) {
 		if ps.State == STATE_STOPPED {
 			p.startPlaying(ps, position)
 		} else if ps.State == STATE_PAUSED || ps.State == STATE_PLAYING {
-			p.player.setPosition(position)
+			p.refreshProgress(ps)
+			if ps.live && ps.duration > 0 && position > ps.duration-LIVE_EDGE_MARGIN {
+				// Seek to the live edge. Seeking past the end of the
+				// seekable range would stop the stream.
+				position = ps.duration - LIVE_EDGE_MARGIN/2
+			}
+			if err := p.player.setPosition(position); err != nil {
+				logger.Warnln("could not seek:", err)
+				return
+			}
+			p.anchorTimeline(ps, position)
 		} else {
 			logger.Warnf("state is not paused or playing while seeking (state: %d) - ignoring\n", ps.State)
 		}
@@ -330,15 +667,15 @@ func (p *MediaPlayer) Seek(position time.Duration) {
 }
 
 // SetVolume sets the volume of the player to the specified value (0-100).
-func (p *MediaPlayer) SetVolume(volume int, volumeChan chan int) {
+func (p *MediaPlayer) SetVolume(volume int) {
 	p.getPlayState(func(ps *PlayState) {
 		ps.Volume = volume
-		p.applyVolume(ps, volumeChan)
+		p.applyVolume(ps)
 	})
 }
 
 // ChangeVolume increases or decreases the volume by the specified delta.
-func (p *MediaPlayer) ChangeVolume(delta int, volumeChan chan int) {
+func (p *MediaPlayer) ChangeVolume(delta int) {
 	p.getPlayState(func(ps *PlayState) {
 		ps.Volume += delta
 		// pressing 'volume up' or 'volume down' keeps sending volume
@@ -350,29 +687,33 @@ func (p *MediaPlayer) ChangeVolume(delta int, volumeChan chan int) {
 			ps.Volume = 100
 		}
 
-		p.applyVolume(ps, volumeChan)
+		p.applyVolume(ps)
+	})
+}
+
+// SetMute mutes or unmutes the player.
+func (p *MediaPlayer) SetMute(muted bool) {
+	p.getPlayState(func(ps *PlayState) {
+		ps.Muted = muted
+		p.applyVolume(ps)
 	})
 }
 
-func (p *MediaPlayer) applyVolume(ps *PlayState, volumeChan chan int) {
+func (p *MediaPlayer) applyVolume(ps *PlayState) {
 	if ps.State == STATE_PLAYING || ps.State == STATE_PAUSED {
-		p.player.setVolume(ps.Volume)
+		p.player.setVolume(ps.Volume, ps.Muted)
+		ps.volumeChanged = time.Now()
 	} else {
 		ps.newVolume = true
 	}
-	volumeChan <- ps.Volume
+	p.events <- VolumeChange{ps.Volume, ps.Muted}
 }
 
-// RequestVolume asynchronously gets the volume and sends it over the channel
-// volumeChan. See RequestPlaylist for how this works.
-func (p *MediaPlayer) RequestVolume(volumeChan chan int) {
+// RequestVolume asynchronously sends the volume and mute state as a
+// VolumeChange event.
+func (p *MediaPlayer) RequestVolume() {
 	go p.getPlayState(func(ps *PlayState) {
-
-		select {
-		case <-volumeChan:
-		default:
-		}
-		volumeChan <- ps.Volume
+		p.events <- VolumeChange{ps.Volume, ps.Muted}
 	})
 }
 
@@ -391,19 +732,337 @@ func (p *MediaPlayer) Stop() {
 	p.getPlayState(p.stop)
 }
 
+// SetSubtitles shows subtitles in the given language, or turns them off when
+// the language is empty. The language is also used for the following videos.
+func (p *MediaPlayer) SetSubtitles(language string) {
+	p.getPlayState(func(ps *PlayState) {
+		ps.subtitleSet = true
+		ps.subtitleLanguage = normalizeLanguage(language)
+		if ps.State == STATE_PLAYING || ps.State == STATE_PAUSED {
+			p.applySubtitles(ps, true)
+		} else {
+			// Will be applied when the video starts playing.
+			p.events <- SubtitlesChange{ps.Video(), ps.subtitle}
+		}
+	})
+}
+
+// RequestSubtitles asynchronously sends the current subtitle track as a
+// SubtitlesChange event.
+func (p *MediaPlayer) RequestSubtitles() {
+	go p.getPlayState(func(ps *PlayState) {
+		p.events <- SubtitlesChange{ps.Video(), ps.subtitle}
+	})
+}
+
+// applySubtitles applies the subtitle language chosen by a remote, if any, to
+// the playing video and reports the subtitle track. When report is true, it is
+// reported even if it hasn't changed.
+func (p *MediaPlayer) applySubtitles(ps *PlayState, report bool) {
+	if ps.subtitleSet {
+		err := p.player.setSubtitle(ps.subtitleLanguage)
+		if err != nil {
+			if ps.subtitlePending != ps.Video() {
+				logger.Println("could not set subtitles:", err)
+			}
+			// The subtitles may not have been loaded yet, try again later.
+			ps.subtitlePending = ps.Video()
+		} else {
+			ps.subtitlePending = ""
+		}
+	}
+	if !p.refreshSubtitles(ps) && report {
+		p.events <- SubtitlesChange{ps.Video(), ps.subtitle}
+	}
+}
+
+// pollSubtitles checks for subtitle changes made on the media player itself.
+func (p *MediaPlayer) pollSubtitles(ps *PlayState) {
+	if ps.subtitlePending != "" && ps.subtitlePending == ps.Video() {
+		p.applySubtitles(ps, false)
+		return
+	}
+	if p.refreshSubtitles(ps) && ps.subtitleSet {
+		// Somebody changed the subtitles on the TV: keep them for the next
+		// videos.
+		ps.subtitleLanguage = ps.subtitle.Language
+	}
+}
+
+// refreshSubtitles gets the current subtitle track, and reports it when it
+// has changed. It returns true when it has changed.
+func (p *MediaPlayer) refreshSubtitles(ps *PlayState) bool {
+	state, err := p.player.getSubtitles()
+	if err != nil {
+		return false
+	}
+	return p.updateSubtitles(ps, state)
+}
+
+// updateSubtitles reports the current subtitle track of the state when it has
+// changed. It returns true when it has changed.
+func (p *MediaPlayer) updateSubtitles(ps *PlayState, state SubtitleState) bool {
+	current := Subtitle{}
+	if state.Enabled {
+		current = state.Current
+	}
+	if current == ps.subtitle {
+		return false
+	}
+
+	ps.subtitle = current
+	p.events <- SubtitlesChange{ps.Video(), current}
+	return true
+}
+
+// SetAudioLanguages sets the preferred audio languages, most preferred first.
+// The audio stream is chosen when a video starts playing.
+func (p *MediaPlayer) SetAudioLanguages(languages []string) {
+	p.getPlayState(func(ps *PlayState) {
+		ps.audioLanguages = languages
+	})
+}
+
+// SetStopPolicy sets what happens when the user stops a video on the media
+// player itself.
+func (p *MediaPlayer) SetStopPolicy(policy StopPolicy) {
+	p.getPlayState(func(ps *PlayState) {
+		ps.stopPolicy = policy
+	})
+}
+
+// applyAudioLanguages chooses the audio stream for the current video, once
+// the streams are known.
+func (p *MediaPlayer) applyAudioLanguages(ps *PlayState) {
+	if len(ps.audioLanguages) == 0 || ps.audioVideo == ps.Video() {
+		return
+	}
+
+	streams, current, err := p.player.getAudioStreams()
+	if err != nil {
+		return
+	}
+	p.chooseAudioStream(ps, streams, current)
+}
+
+// chooseAudioStream switches to the stream in the most preferred language,
+// once the streams of the current video are known.
+func (p *MediaPlayer) chooseAudioStream(ps *PlayState, streams []AudioStream, current int) {
+	if len(ps.audioLanguages) == 0 || ps.audioVideo == ps.Video() {
+		return
+	}
+	if len(streams) == 0 {
+		// not loaded yet, try again later
+		return
+	}
+	ps.audioVideo = ps.Video()
+
+	for _, language := range ps.audioLanguages {
+		for _, stream := range streams {
+			if !sameLanguage(stream.Language, language) {
+				continue
+			}
+			if stream.Index != current {
+				logger.Println("switching to audio stream", stream.Index, stream.Language, stream.Name)
+				if err := p.player.setAudioStream(stream.Index); err != nil {
+					logger.Warnln("could not switch audio stream:", err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// GetAudioStreams returns the audio streams of the current video and the
+// index of the current stream. It blocks.
+func (p *MediaPlayer) GetAudioStreams() ([]AudioStream, int, error) {
+	var streams []AudioStream
+	current := -1
+	err := PROPERTY_UNAVAILABLE
+	p.getPlayState(func(ps *PlayState) {
+		if ps.State == STATE_PLAYING || ps.State == STATE_PAUSED {
+			streams, current, err = p.player.getAudioStreams()
+		}
+	})
+	return streams, current, err
+}
+
+// SetAudioStream switches to another audio stream of the current video,
+// either by index or (when index is negative) by language.
+func (p *MediaPlayer) SetAudioStream(index int, language string) error {
+	err := PROPERTY_UNAVAILABLE
+	p.getPlayState(func(ps *PlayState) {
+		if ps.State != STATE_PLAYING && ps.State != STATE_PAUSED {
+			return
+		}
+		if index < 0 {
+			var streams []AudioStream
+			streams, _, err = p.player.getAudioStreams()
+			if err != nil {
+				return
+			}
+			err = errors.New("no audio stream in language " + language)
+			for _, stream := range streams {
+				if sameLanguage(stream.Language, language) {
+					index = stream.Index
+					err = nil
+					break
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+		err = p.player.setAudioStream(index)
+		// Don't override a manual choice.
+		ps.audioVideo = ps.Video()
+	})
+	return err
+}
+
+// SetRepeat changes the repeat mode.
+func (p *MediaPlayer) SetRepeat(mode RepeatMode) {
+	p.getPlayState(func(ps *PlayState) {
+		ps.Repeat = mode
+		p.events <- PlaylistModeChange{ps.Repeat, ps.Shuffle}
+	})
+}
+
+// SetShuffle enables or disables shuffle. A new random order is chosen every
+// time shuffle is enabled, starting with the current video.
+func (p *MediaPlayer) SetShuffle(shuffle bool) {
+	p.getPlayState(func(ps *PlayState) {
+		if shuffle && !ps.Shuffle {
+			ps.shuffleOrder = newShuffleOrder(ps.Playlist, ps.Index)
+		} else if !shuffle {
+			ps.shuffleOrder = nil
+		}
+		ps.Shuffle = shuffle
+		p.events <- PlaylistModeChange{ps.Repeat, ps.Shuffle}
+	})
+}
+
+// GetPlaylistMode returns the repeat mode and whether shuffle is enabled. It
+// blocks.
+func (p *MediaPlayer) GetPlaylistMode() (RepeatMode, bool) {
+	mode := REPEAT_OFF
+	shuffle := false
+	p.getPlayState(func(ps *PlayState) {
+		mode = ps.Repeat
+		shuffle = ps.Shuffle
+	})
+	return mode, shuffle
+}
+
+// RequestPlaylistMode asynchronously sends the repeat and shuffle mode as a
+// PlaylistModeChange event.
+func (p *MediaPlayer) RequestPlaylistMode() {
+	go p.getPlayState(func(ps *PlayState) {
+		p.events <- PlaylistModeChange{ps.Repeat, ps.Shuffle}
+	})
+}
+
+// SetRate changes the playback speed, also for the following videos. It
+// returns ErrUnsupportedRate when the media player can't play at that speed.
+func (p *MediaPlayer) SetRate(rate float64) error {
+	if rate < MIN_RATE || rate > MAX_RATE {
+		return errors.New("playback speed out of range")
+	}
+
+	var err error
+	p.getPlayState(func(ps *PlayState) {
+		if ps.State == STATE_PLAYING || ps.State == STATE_PAUSED {
+			position := p.getPosition(ps)
+			err = p.player.setRate(rate)
+			if err == nil {
+				ps.Rate = rate
+				p.anchorTimeline(ps, position)
+				// Remotes extrapolate the position with the rate, so give them
+				// a new starting point.
+				p.setPlayState(ps, ps.State, -1)
+			} else {
+				// The remotes get the speed that is still used.
+				logger.Warnln("could not set playback speed:", err)
+			}
+		} else {
+			ps.Rate = rate
+			ps.newRate = rate != 1
+		}
+		p.events <- RateChange{ps.Rate}
+	})
+	return err
+}
+
+// GetRate returns the playback speed. It blocks.
+func (p *MediaPlayer) GetRate() float64 {
+	rate := 1.0
+	p.getPlayState(func(ps *PlayState) {
+		rate = ps.Rate
+	})
+	return rate
+}
+
+// RequestRate asynchronously sends the playback speed as a RateChange event.
+func (p *MediaPlayer) RequestRate() {
+	go p.getPlayState(func(ps *PlayState) {
+		p.events <- RateChange{ps.Rate}
+	})
+}
+
+// SendKey sends a key press to the media player, to control its user
+// interface. It returns ErrUnsupportedKey for keys the media player doesn't
+// know.
+func (p *MediaPlayer) SendKey(key Key) error {
+	err := PROPERTY_UNAVAILABLE
+	p.getPlayState(func(ps *PlayState) {
+		err = p.player.sendKey(key)
+	})
+	return err
+}
+
+// Notify shows a notification on the screen. It doesn't block.
+func (p *MediaPlayer) Notify(title, message string, displayTime time.Duration) {
+	go p.getPlayState(func(ps *PlayState) {
+		p.player.notify(title, message, displayTime)
+	})
+}
+
 // Function run is the mainloop of the player. It mainly handles state change
 // events.
-func (p *MediaPlayer) run(playerEventChan chan State, initialVolume int) {
+func (p *MediaPlayer) run(playerEventChan chan interface{}, initialVolume int, autoplay bool) {
 	ps := PlayState{}
 	ps.Volume = initialVolume
+	ps.Rate = 1
+	ps.Autoplay = autoplay
 	ps.nextState = -1
 
+	// Kodi doesn't send events for all changes.
+	poll := time.NewTicker(POLL_INTERVAL)
+	defer poll.Stop()
+
 	for {
 		select {
+		case <-p.quit:
+			// Make sure nobody gets the PlayState after the player has quit.
+			close(p.stateChange)
+			close(p.playstateChan)
+			return
+		default:
+		}
+
+		select {
+		case <-poll.C:
+			if ps.State == STATE_PLAYING || ps.State == STATE_PAUSED {
+				p.resyncTimeline(&ps)
+				p.pollSubtitles(&ps)
+				p.applyAudioLanguages(&ps)
+			}
+
 		case p.playstateChan <- ps:
 			// Synchronize access to the PlayState structure.
 			// See the documentation of PlayState.
 			ps = <-p.playstateChan
+			p.checkQueue(&ps)
 
 		case event, ok := <-playerEventChan:
 			if !ok {
@@ -412,29 +1071,253 @@ func (p *MediaPlayer) run(playerEventChan chan State, initialVolume int) {
 				close(p.playstateChan)
 				return
 			}
+			if _, stopped := event.(userStopEvent); stopped && ps.stopPolicy == STOP_QUIT {
+				logger.Println("stopped by the user - quitting")
+				p.player.quit()
+				close(p.stateChange)
+				close(p.playstateChan)
+				return
+			}
 
-			switch event {
-			case STATE_PLAYING:
-				if ps.newVolume {
-					ps.newVolume = false
-					p.player.setVolume(ps.Volume)
-				}
+			switch event := event.(type) {
+			case connectedEvent:
+				p.handleConnected(&ps)
+			case State:
+				p.handleState(&ps, event)
+			case userStopEvent:
+				p.handleUserStop(&ps)
+			case avStartEvent:
+				p.handleAVStart(&ps)
+			case speedEvent:
+				p.handleSpeed(&ps, event)
+			case seekEvent:
+				p.handleSeek(&ps, event)
+			case volumeEvent:
+				p.handleVolume(&ps, event)
+			}
+			p.checkQueue(&ps)
+		}
+	}
+}
 
-				p.setPlayState(&ps, STATE_PLAYING, -1)
+// handleState handles a state change of the media player.
+func (p *MediaPlayer) handleState(ps *PlayState, state State) {
+	switch state {
+	case STATE_PLAYING:
+		if ps.newVolume {
+			ps.newVolume = false
+			p.player.setVolume(ps.Volume, ps.Muted)
+			ps.volumeChanged = time.Now()
+		}
 
-			case STATE_PAUSED:
-				if ps.State == STATE_BUFFERING {
-					// The video has been paused while the stream for the next
-					// video is being loaded.
-					break
-				}
+		if ps.newRate {
+			ps.newRate = false
+			if err := p.player.setRate(ps.Rate); err != nil {
+				logger.Warnln("could not set playback speed:", err)
+				ps.Rate = 1
+				p.events <- RateChange{ps.Rate}
+			}
+		}
 
-				p.setPlayState(&ps, STATE_PAUSED, -1)
+		// The timeline is anchored again, with the new state.
+		ps.timeline.invalidate()
+		p.applyStartPosition(ps)
+		p.setPlayState(ps, STATE_PLAYING, -1)
+		p.prepareUpNext(ps)
+		p.applySubtitles(ps, false)
+		p.applyAudioLanguages(ps)
 
-			case STATE_STOPPED:
-				// There may be more videos.
-				p.nextVideo(&ps)
-			}
+	case STATE_PAUSED:
+		if ps.State == STATE_BUFFERING {
+			// The video has been paused while the stream for the next
+			// video is being loaded.
+			break
+		}
+
+		ps.timeline.invalidate()
+		p.setPlayState(ps, STATE_PAUSED, -1)
+
+	case STATE_STOPPED:
+		if ps.State == STATE_BUFFERING {
+			// The previous video stopped while the next one is being
+			// started, or the media player is switching to it.
+			break
+		}
+		p.videoEnded(ps)
+	}
+}
+
+// applyStartPosition seeks to the position a video was started at, if the
+// media player didn't start there. Until then, the start position is reported
+// instead of the actual position, see setPlayState.
+func (p *MediaPlayer) applyStartPosition(ps *PlayState) {
+	if ps.startPosition <= 0 {
+		return
+	}
+
+	progress, err := p.player.getProgress()
+	if err != nil {
+		// The video may not have started yet, try again on avStartEvent.
+		return
+	}
+	p.seekToStart(ps, progress.Position)
+}
+
+// seekToStart seeks to the start position when the media player started the
+// video at another position. It returns the position after that.
+func (p *MediaPlayer) seekToStart(ps *PlayState, position time.Duration) time.Duration {
+	start := ps.startPosition
+	ps.startPosition = 0
+	if diff := position - start; diff > START_POSITION_MARGIN || diff < -START_POSITION_MARGIN {
+		logger.Println("seeking to start position", start)
+		p.player.setPosition(start)
+		return start
+	}
+	return position
+}
+
+// handleAVStart finishes starting a video, for what wasn't possible yet when
+// the video started playing. The properties that are needed for that are read
+// together.
+func (p *MediaPlayer) handleAVStart(ps *PlayState) {
+	if ps.State != STATE_PLAYING && ps.State != STATE_PAUSED {
+		return
+	}
+	props, err := p.player.getVideoProperties()
+	if err != nil {
+		// Read them one by one instead.
+		ps.timeline.invalidate()
+		p.applyStartPosition(ps)
+		p.applySubtitles(ps, false)
+		p.applyAudioLanguages(ps)
+		p.reportState(ps, p.getPosition(ps))
+		return
+	}
+
+	position := props.progress.Position
+	if ps.startPosition > 0 {
+		position = p.seekToStart(ps, position)
+	}
+	props.progress.Position = position
+	p.setProgress(ps, props.progress)
+	if ps.subtitleSet {
+		p.applySubtitles(ps, false)
+	} else {
+		p.updateSubtitles(ps, props.subtitles)
+	}
+	p.chooseAudioStream(ps, props.audioStreams, props.audioStream)
+	p.reportState(ps, p.getPosition(ps))
+}
+
+// handleSpeed handles a change of the playback speed on the media player. A
+// tempo change (see isTempo) within the speeds remotes know (see MIN_RATE and
+// MAX_RATE) is reported as RateChange, as is going back to normal speed from a
+// tempo. Fast forwarding and rewinding only change the timeline: they don't
+// change the rate, which is applied again to the next video.
+func (p *MediaPlayer) handleSpeed(ps *PlayState, event speedEvent) {
+	if ps.State != STATE_PLAYING {
+		return
+	}
+	previous := ps.speed
+	ps.speed = event.speed
+	position := p.getPosition(ps)
+	switch {
+	case event.speed == 1 && !isTempo(previous):
+		// Back to normal after fast forwarding or rewinding. This doesn't
+		// reset the rate: the tempo isn't changed by fast forwarding.
+		p.anchorTimeline(ps, position)
+	case event.speed == 1 || isTempo(event.speed) && event.speed >= MIN_RATE && event.speed <= MAX_RATE:
+		if ps.Rate != event.speed {
+			ps.Rate = event.speed
+			p.events <- RateChange{ps.Rate}
+		}
+		p.anchorTimeline(ps, position)
+	default:
+		ps.timeline.set(position, event.speed)
+	}
+	p.reportState(ps, position)
+}
+
+// isTempo returns whether a speed reported by Kodi is a tempo, as set with
+// Player.SetTempo. Fast forwarding and rewinding use whole speeds (2, 4, -2,
+// ...), tempos are between 0.8 and 1.5 by default.
+func isTempo(speed float64) bool {
+	return speed != math.Trunc(speed)
+}
+
+// handleUserStop handles a stop by the user on the media player, unless the
+// stop policy is STOP_QUIT (see run).
+func (p *MediaPlayer) handleUserStop(ps *PlayState) {
+	if ps.State == STATE_STOPPED {
+		return
+	}
+	switch ps.stopPolicy {
+	case STOP_NEXT:
+		p.nextVideo(ps)
+	default:
+		p.setPlayState(ps, STATE_STOPPED, 0)
+	}
+}
+
+// handleConnected checks the state after the backend has (re)connected to the
+// media player. When the media player has been restarted, the video is gone.
+func (p *MediaPlayer) handleConnected(ps *PlayState) {
+	if volume, muted, err := p.player.getVolume(); err != nil {
+		logger.Warnln("could not get volume:", err)
+	} else if !ps.newVolume {
+		// Unless a remote has already chosen a volume, which will be
+		// applied when the next video starts.
+		p.handleVolume(ps, volumeEvent{volume, muted})
+	}
+
+	if ps.pendingVideo != "" {
+		video := ps.pendingVideo
+		ps.pendingVideo = ""
+		if ps.State == STATE_BUFFERING && ps.Video() == video {
+			p.playVideo(ps, ps.pendingPosition)
 		}
+		return
+	}
+
+	if ps.State != STATE_PLAYING && ps.State != STATE_PAUSED {
+		return
+	}
+	if _, err := p.player.getProgress(); err != nil {
+		logger.Warnln("video has gone after reconnecting:", err)
+		p.setPlayState(ps, STATE_STOPPED, 0)
+		return
+	}
+	// Pick up anything that changed while disconnected.
+	ps.timeline.invalidate()
+	p.reportState(ps, p.getPosition(ps))
+}
+
+// handleSeek handles a seek on the media player, whether it was requested by a
+// remote or done on the media player itself.
+func (p *MediaPlayer) handleSeek(ps *PlayState, event seekEvent) {
+	if ps.State != STATE_PLAYING && ps.State != STATE_PAUSED {
+		return
+	}
+	position := event.position
+	if position < 0 {
+		position = p.refreshProgress(ps)
+	} else {
+		p.anchorTimeline(ps, position)
+	}
+	p.reportState(ps, position)
+}
+
+// handleVolume handles a volume change on the media player itself.
+func (p *MediaPlayer) handleVolume(ps *PlayState, event volumeEvent) {
+	if time.Since(ps.volumeChanged) < VOLUME_EVENT_DELAY {
+		// Probably caused by a volume change of a remote, which may be older
+		// than the current volume.
+		return
+	}
+	if event.volume != ps.Volume || event.muted != ps.Muted {
+		ps.Volume = event.volume
+		ps.Muted = event.muted
+		ps.newVolume = false
+		p.events <- VolumeChange{ps.Volume, ps.Muted}
 	}
 }
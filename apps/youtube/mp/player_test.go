@@ -0,0 +1,48 @@
+package mp
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHandleSpeed(t *testing.T) {
+	p := &MediaPlayer{
+		stateChange: make(chan StateChange, 20),
+		events:      make(chan Event, 20),
+	}
+	ps := &PlayState{State: STATE_PLAYING, Rate: 1}
+	ps.timeline.set(0, 1)
+
+	for _, test := range []struct {
+		speed    float64
+		rate     float64 // rate afterwards
+		timeline float64 // speed of the timeline afterwards
+	}{
+		{2, 1, 2},          // fast forwarding
+		{1, 1, 1},          // and playing again
+		{1.5, 1.5, 1.5},    // tempo
+		{4, 1.5, 4},        // fast forwarding doesn't change the tempo
+		{-2, 1.5, -2},      // nor does rewinding
+		{1, 1.5, 1.5},      // so the tempo stays after it
+		{1.25, 1.25, 1.25}, // another tempo
+		{1, 1, 1},          // and back to normal from the tempo
+		{0.8, 0.8, 0.8},
+		{2, 0.8, 2},
+		{1, 0.8, 0.8},
+	} {
+		p.handleSpeed(ps, speedEvent{test.speed})
+		if ps.Rate != test.rate || ps.timeline.rate != test.timeline {
+			t.Errorf("speed %g: got rate %g and timeline at %g, expected %g and %g", test.speed, ps.Rate, ps.timeline.rate, test.rate, test.timeline)
+		}
+	}
+
+	var changes []float64
+	for len(p.events) > 0 {
+		if change, ok := (<-p.events).(RateChange); ok {
+			changes = append(changes, change.Rate)
+		}
+	}
+	if fmt.Sprint(changes) != "[1.5 1.25 1 0.8]" {
+		t.Errorf("got rate changes %v", changes)
+	}
+}
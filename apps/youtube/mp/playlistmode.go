@@ -0,0 +1,162 @@
+package mp
+
+import (
+	"math/rand"
+)
+
+// # Repeat and shuffle
+//
+// With shuffle enabled, videos are played in a random order that is chosen
+// once. The order is kept as a list of video IDs, so it survives edits of the
+// queue: removed videos are dropped from it, and added videos are inserted at
+// a random position that hasn't been played yet.
+
+type RepeatMode int
+
+const (
+	REPEAT_OFF RepeatMode = iota
+	REPEAT_ONE            // repeat the current video
+	REPEAT_ALL            // start the queue again when it has finished
+)
+
+func (m RepeatMode) String() string {
+	switch m {
+	case REPEAT_OFF:
+		return "off"
+	case REPEAT_ONE:
+		return "one"
+	case REPEAT_ALL:
+		return "all"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseRepeatMode converts the string form of a RepeatMode.
+func ParseRepeatMode(s string) (RepeatMode, bool) {
+	for _, mode := range []RepeatMode{REPEAT_OFF, REPEAT_ONE, REPEAT_ALL} {
+		if s == mode.String() {
+			return mode, true
+		}
+	}
+	return REPEAT_OFF, false
+}
+
+// newShuffleOrder returns a random order for the playlist, starting with the
+// video at index first.
+func newShuffleOrder(playlist []string, first int) []string {
+	order := make([]string, 0, len(playlist))
+	for i, videoId := range playlist {
+		if i != first {
+			order = append(order, videoId)
+		}
+	}
+	rand.Shuffle(len(order), func(i, j int) {
+		order[i], order[j] = order[j], order[i]
+	})
+	if first >= 0 && first < len(playlist) {
+		order = append([]string{playlist[first]}, order...)
+	}
+	return order
+}
+
+// updateShuffleOrder updates the shuffle order after the playlist has been
+// edited. Videos are inserted after the position of current in the order.
+func updateShuffleOrder(order, playlist []string, current string) []string {
+	// count how often every video is in the new playlist
+	counts := make(map[string]int)
+	for _, videoId := range playlist {
+		counts[videoId]++
+	}
+
+	newOrder := make([]string, 0, len(playlist))
+	for _, videoId := range order {
+		if counts[videoId] > 0 {
+			counts[videoId]--
+			newOrder = append(newOrder, videoId)
+		}
+	}
+
+	start := 0
+	for i, videoId := range newOrder {
+		if videoId == current {
+			start = i + 1
+			break
+		}
+	}
+
+	// insert new videos, in playlist order
+	for _, videoId := range playlist {
+		if counts[videoId] == 0 {
+			continue
+		}
+		counts[videoId]--
+		i := start + rand.Intn(len(newOrder)-start+1)
+		newOrder = append(newOrder, "")
+		copy(newOrder[i+1:], newOrder[i:])
+		newOrder[i] = videoId
+	}
+	return newOrder
+}
+
+// playOrder returns the indices of the playlist in the order they will be
+// played.
+func playOrder(ps *PlayState) []int {
+	order := make([]int, 0, len(ps.Playlist))
+	if !ps.Shuffle {
+		for i := range ps.Playlist {
+			order = append(order, i)
+		}
+		return order
+	}
+
+	used := make([]bool, len(ps.Playlist))
+	for _, videoId := range ps.shuffleOrder {
+		for i, v := range ps.Playlist {
+			if v == videoId && !used[i] {
+				used[i] = true
+				order = append(order, i)
+				break
+			}
+		}
+	}
+	return order
+}
+
+// nextIndex returns the index of the video after the current video, taking
+// shuffle and repeat-all into account.
+func nextIndex(ps *PlayState) (int, bool) {
+	order := playOrder(ps)
+	for i, index := range order {
+		if index != ps.Index {
+			continue
+		}
+		if i+1 < len(order) {
+			return order[i+1], true
+		}
+		break
+	}
+	if ps.Repeat == REPEAT_ALL && len(order) > 0 {
+		return order[0], true
+	}
+	return -1, false
+}
+
+// previousIndex returns the index of the video before the current video,
+// taking shuffle and repeat-all into account.
+func previousIndex(ps *PlayState) (int, bool) {
+	order := playOrder(ps)
+	for i, index := range order {
+		if index != ps.Index {
+			continue
+		}
+		if i > 0 {
+			return order[i-1], true
+		}
+		break
+	}
+	if ps.Repeat == REPEAT_ALL && len(order) > 1 {
+		return order[len(order)-1], true
+	}
+	return -1, false
+}
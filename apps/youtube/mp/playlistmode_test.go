@@ -0,0 +1,136 @@
+package mp
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// sameVideos returns whether both lists have the same videos, in any order.
+func sameVideos(a, b []string) bool {
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return strings.Join(a, ",") == strings.Join(b, ",")
+}
+
+// without returns the list without the given videos.
+func without(list []string, videoIds ...string) []string {
+	var result []string
+	for _, v := range list {
+		keep := true
+		for _, videoId := range videoIds {
+			if v == videoId {
+				keep = false
+			}
+		}
+		if keep {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func indexOf(list []string, videoId string) int {
+	for i, v := range list {
+		if v == videoId {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestNewShuffleOrder(t *testing.T) {
+	playlist := []string{"a", "b", "c", "d", "e"}
+	for i := 0; i < 20; i++ {
+		order := newShuffleOrder(playlist, 2)
+		if order[0] != "c" || !sameVideos(order, playlist) {
+			t.Fatalf("got order %v", order)
+		}
+	}
+}
+
+func TestUpdateShuffleOrder(t *testing.T) {
+	order := []string{"c", "a", "e", "b", "d"}
+	for _, test := range []struct {
+		name     string
+		playlist []string
+		current  string
+		added    []string
+	}{
+		{"reordered", []string{"e", "d", "c", "b", "a"}, "a", nil},
+		{"removed", []string{"a", "c", "e"}, "a", nil},
+		{"removed current", []string{"b", "c", "d", "e"}, "a", nil},
+		{"added", []string{"a", "b", "c", "d", "e", "f", "g"}, "a", []string{"f", "g"}},
+		{"added and removed", []string{"a", "f", "c", "e"}, "e", []string{"f"}},
+		{"added at the end", []string{"a", "b", "c", "d", "e", "f"}, "d", []string{"f"}},
+	} {
+		for i := 0; i < 20; i++ {
+			newOrder := updateShuffleOrder(order, test.playlist, test.current)
+			if !sameVideos(newOrder, test.playlist) {
+				t.Fatalf("%s: order %v doesn't match playlist %v", test.name, newOrder, test.playlist)
+			}
+			// The videos that were in the order keep their order.
+			kept := without(order, without(order, test.playlist...)...)
+			if got := without(newOrder, test.added...); strings.Join(got, ",") != strings.Join(kept, ",") {
+				t.Fatalf("%s: order changed from %v to %v", test.name, kept, got)
+			}
+			// Added videos are played after the current video.
+			for _, videoId := range test.added {
+				if current := indexOf(newOrder, test.current); current >= 0 && indexOf(newOrder, videoId) < current {
+					t.Fatalf("%s: %s added before the current video: %v", test.name, videoId, newOrder)
+				}
+			}
+		}
+	}
+}
+
+func TestUpdateShuffleOrderDuplicates(t *testing.T) {
+	order := []string{"b", "a", "b"}
+	newOrder := updateShuffleOrder(order, []string{"a", "b"}, "a")
+	if strings.Join(newOrder, ",") != "b,a" {
+		t.Errorf("got order %v after removing a duplicate", newOrder)
+	}
+	newOrder = updateShuffleOrder(newOrder, []string{"a", "b", "b"}, "a")
+	if strings.Join(newOrder, ",") != "b,a,b" {
+		t.Errorf("got order %v after adding a duplicate", newOrder)
+	}
+}
+
+func TestShuffleNextIndex(t *testing.T) {
+	ps := &PlayState{
+		Playlist:     []string{"a", "b", "c"},
+		Index:        1,
+		Shuffle:      true,
+		shuffleOrder: []string{"b", "c", "a"},
+	}
+	var played []string
+	for {
+		index, ok := nextIndex(ps)
+		if !ok {
+			break
+		}
+		ps.Index = index
+		played = append(played, ps.Video())
+	}
+	if strings.Join(played, ",") != "c,a" {
+		t.Errorf("played %v", played)
+	}
+	if index, ok := previousIndex(ps); !ok || ps.Playlist[index] != "c" {
+		t.Errorf("previous video is %d", index)
+	}
+
+	// The order stays when the queue is edited.
+	ps.Playlist = []string{"d", "a", "c", "b"}
+	ps.Index = 1
+	ps.shuffleOrder = updateShuffleOrder(ps.shuffleOrder, ps.Playlist, "a")
+	if index, ok := nextIndex(ps); !ok || ps.Playlist[index] != "d" {
+		t.Errorf("after adding d, next video is %d", index)
+	}
+	ps.Repeat = REPEAT_ALL
+	ps.Index = 0
+	if index, ok := nextIndex(ps); !ok || ps.Playlist[index] != "b" {
+		t.Errorf("with repeat all, next video is %d", index)
+	}
+}
@@ -0,0 +1,127 @@
+package mp
+
+import (
+	"strings"
+)
+
+// YouTube identifies subtitle languages with two-letter (ISO 639-1) codes,
+// sometimes with a region ("en-GB"). Kodi usually uses three-letter (ISO 639-2)
+// codes, but that depends on the source of the subtitles.
+var languageCodes = map[string]string{
+	"ar": "ara",
+	"cs": "cze",
+	"da": "dan",
+	"de": "ger",
+	"el": "gre",
+	"en": "eng",
+	"es": "spa",
+	"fi": "fin",
+	"fr": "fre",
+	"he": "heb",
+	"hi": "hin",
+	"hu": "hun",
+	"id": "ind",
+	"it": "ita",
+	"ja": "jpn",
+	"ko": "kor",
+	"nl": "dut",
+	"no": "nor",
+	"pl": "pol",
+	"pt": "por",
+	"ro": "rum",
+	"ru": "rus",
+	"sv": "swe",
+	"th": "tha",
+	"tr": "tur",
+	"uk": "ukr",
+	"vi": "vie",
+	"zh": "chi",
+}
+
+// Alternative ISO 639-2 codes (terminology instead of bibliographic).
+var alternativeLanguageCodes = map[string]string{
+	"ces": "cze",
+	"deu": "ger",
+	"ell": "gre",
+	"fra": "fre",
+	"nld": "dut",
+	"ron": "rum",
+	"zho": "chi",
+}
+
+// English language names, which Kodi uses for some subtitles, for example when
+// they come from a file.
+var languageNames = map[string]string{
+	"arabic":     "ar",
+	"chinese":    "zh",
+	"czech":      "cs",
+	"danish":     "da",
+	"dutch":      "nl",
+	"english":    "en",
+	"finnish":    "fi",
+	"french":     "fr",
+	"german":     "de",
+	"greek":      "el",
+	"hebrew":     "he",
+	"hindi":      "hi",
+	"hungarian":  "hu",
+	"indonesian": "id",
+	"italian":    "it",
+	"japanese":   "ja",
+	"korean":     "ko",
+	"norwegian":  "no",
+	"polish":     "pl",
+	"portuguese": "pt",
+	"romanian":   "ro",
+	"russian":    "ru",
+	"spanish":    "es",
+	"swedish":    "sv",
+	"thai":       "th",
+	"turkish":    "tr",
+	"ukrainian":  "uk",
+	"vietnamese": "vi",
+}
+
+// normalizeLanguage converts a language code as used by Kodi or YouTube to a
+// two-letter code, if it is known. Language names are converted too. Other
+// codes are returned lowercased.
+func normalizeLanguage(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	name := language
+	if i := strings.Index(name, " ("); i > 0 {
+		// strip the region: "english (united states)"
+		name = name[:i]
+	}
+	if code, ok := languageNames[name]; ok {
+		return code
+	}
+	if i := strings.IndexAny(language, "-_"); i > 0 {
+		// strip the region
+		language = language[:i]
+	}
+	if code, ok := alternativeLanguageCodes[language]; ok {
+		language = code
+	}
+	for short, long := range languageCodes {
+		if language == long {
+			return short
+		}
+	}
+	return language
+}
+
+// sameLanguage returns true when both language codes refer to the same
+// language.
+func sameLanguage(a, b string) bool {
+	return a != "" && normalizeLanguage(a) == normalizeLanguage(b)
+}
+
+// findSubtitle returns the first subtitle track with the given language.
+func findSubtitle(subtitles []Subtitle, language string) (Subtitle, bool) {
+	for _, subtitle := range subtitles {
+		if sameLanguage(subtitle.Language, language) {
+			return subtitle, true
+		}
+	}
+	return Subtitle{}, false
+}
@@ -0,0 +1,54 @@
+package mp
+
+import (
+	"testing"
+)
+
+func TestNormalizeLanguage(t *testing.T) {
+	for _, test := range []struct {
+		language, code string
+	}{
+		{"en", "en"},
+		{"eng", "en"},
+		{"ENG", "en"},
+		{" eng ", "en"},
+		{"ger", "de"},
+		{"deu", "de"}, // terminology code
+		{"fra", "fr"},
+		{"fre", "fr"},
+		{"zho", "zh"},
+		{"en-GB", "en"},
+		{"pt_BR", "pt"},
+		{"zh-Hans", "zh"},
+		{"English", "en"},
+		{"english", "en"},
+		{"Portuguese (Brazil)", "pt"},
+		{"Dutch", "nl"},
+		{"xx", "xx"}, // unknown codes are kept
+		{"Klingon", "klingon"},
+		{"", ""},
+	} {
+		if code := normalizeLanguage(test.language); code != test.code {
+			t.Errorf("%q: got %q, expected %q", test.language, code, test.code)
+		}
+	}
+}
+
+func TestSameLanguage(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		same bool
+	}{
+		{"en", "eng", true},
+		{"en-US", "English", true},
+		{"nl", "dut", true},
+		{"de", "deu", true},
+		{"en", "fr", false},
+		{"", "", false},
+		{"", "en", false},
+	} {
+		if same := sameLanguage(test.a, test.b); same != test.same {
+			t.Errorf("%q and %q: got %t", test.a, test.b, same)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package mp
+
+import (
+	"time"
+)
+
+// # Timeline
+//
+// Asking the media player for the position takes a round trip, so the
+// position is tracked locally instead. The timeline is anchored on a known
+// position (when the video starts playing, is paused or seeked), and the
+// position is extrapolated from there using the playback speed. It is resynced
+// with the media player every POLL_INTERVAL, and while playing remotes get a
+// heartbeat so their position doesn't drift either.
+
+// Resync the timeline when it is off by more than this.
+const TIMELINE_MAX_DRIFT = 500 * time.Millisecond
+
+// Send the position to remotes at least this often while playing.
+const HEARTBEAT_INTERVAL = 15 * time.Second
+
+// timeline is the locally tracked position of the current video.
+type timeline struct {
+	valid      bool
+	anchor     time.Duration // position at anchorTime
+	anchorTime time.Time
+	rate       float64 // 0 while paused
+}
+
+// set anchors the timeline at the position.
+func (t *timeline) set(position time.Duration, rate float64) {
+	t.valid = true
+	t.anchor = position
+	t.anchorTime = time.Now()
+	t.rate = rate
+}
+
+// invalidate makes sure the position is asked again next time.
+func (t *timeline) invalidate() {
+	t.valid = false
+}
+
+// position extrapolates the current position. It is never before the start
+// or past the end of the video, if the duration is known. The rate is negative
+// while rewinding.
+func (t *timeline) position(duration time.Duration) time.Duration {
+	elapsed := time.Since(t.anchorTime)
+	position := t.anchor + time.Duration(float64(elapsed)*t.rate)
+	if position < 0 {
+		position = 0
+	}
+	if duration > 0 && position > duration {
+		position = duration
+	}
+	return position
+}
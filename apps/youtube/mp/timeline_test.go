@@ -0,0 +1,78 @@
+package mp
+
+import (
+	"testing"
+	"time"
+)
+
+// elapse moves the anchor of the timeline back, as if time had passed.
+func (t *timeline) elapse(d time.Duration) {
+	t.anchorTime = t.anchorTime.Add(-d)
+}
+
+// near returns whether the position is within a margin for the time the test
+// itself takes.
+func near(position, expected time.Duration) bool {
+	diff := position - expected
+	return diff > -50*time.Millisecond && diff < 50*time.Millisecond
+}
+
+func TestTimeline(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		start    time.Duration
+		rate     float64
+		elapsed  time.Duration
+		duration time.Duration
+		position time.Duration
+	}{
+		{"playing", 10 * time.Second, 1, 2 * time.Second, 0, 12 * time.Second},
+		{"faster", 10 * time.Second, 1.5, 2 * time.Second, 0, 13 * time.Second},
+		{"slower", 10 * time.Second, 0.5, 2 * time.Second, 0, 11 * time.Second},
+		{"fast forward", 10 * time.Second, 4, 2 * time.Second, 0, 18 * time.Second},
+		{"rewinding", 10 * time.Second, -2, 2 * time.Second, 0, 6 * time.Second},
+		{"paused", 10 * time.Second, 0, time.Minute, 0, 10 * time.Second},
+		{"not before the start", 2 * time.Second, -4, 2 * time.Second, 0, 0},
+		{"not past the end", 50 * time.Second, 1, 20 * time.Second, time.Minute, time.Minute},
+		{"within the duration", 10 * time.Second, 1, 2 * time.Second, time.Minute, 12 * time.Second},
+	} {
+		var tl timeline
+		tl.set(test.start, test.rate)
+		if !tl.valid {
+			t.Errorf("%s: timeline isn't valid after set", test.name)
+		}
+		tl.elapse(test.elapsed)
+		if position := tl.position(test.duration); !near(position, test.position) {
+			t.Errorf("%s: got position %s, expected %s", test.name, position, test.position)
+		}
+	}
+}
+
+func TestTimelineAnchor(t *testing.T) {
+	var tl timeline
+	if tl.valid {
+		t.Error("zero timeline is valid")
+	}
+
+	// Playing, then paused: the position stays where it was paused.
+	tl.set(0, 1)
+	tl.elapse(5 * time.Second)
+	paused := tl.position(0)
+	tl.set(paused, 0)
+	tl.elapse(time.Minute)
+	if position := tl.position(0); !near(position, 5*time.Second) {
+		t.Errorf("paused at %s", position)
+	}
+
+	// Resumed at a different rate, after a seek.
+	tl.set(30*time.Second, 1.25)
+	tl.elapse(4 * time.Second)
+	if position := tl.position(0); !near(position, 35*time.Second) {
+		t.Errorf("got %s after seeking and resuming", position)
+	}
+
+	tl.invalidate()
+	if tl.valid {
+		t.Error("timeline is valid after invalidate")
+	}
+}
@@ -0,0 +1,137 @@
+package youtube
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/sargo/kodicast/apps"
+	"github.com/sargo/kodicast/config"
+)
+
+// # Notifications
+//
+// People in the room can't see who took over the TV, so some events are shown
+// as a notification on the screen. Every type of notification can be turned
+// off with the config key "apps.youtube.notify.<type>", and shown for a
+// different time (in milliseconds) with "apps.youtube.notify.<type>.time".
+// Approval notifications are always shown, as they're the only place the
+// approval code is shown.
+
+const (
+	NOTIFY_CONNECT    = "connect"    // a remote has connected
+	NOTIFY_DISCONNECT = "disconnect" // a remote has disconnected
+	NOTIFY_CAST       = "cast"       // a new queue has been cast
+	NOTIFY_ERROR      = "error"      // a video could not be played
+	NOTIFY_APPROVAL   = "approval"   // a remote has to be approved
+)
+
+// Default display times of notifications, in milliseconds.
+var notifyDisplayTimes = map[string]int{
+	NOTIFY_CONNECT:    5000,
+	NOTIFY_DISCONNECT: 5000,
+	NOTIFY_CAST:       5000,
+	NOTIFY_ERROR:      10000,
+	NOTIFY_APPROVAL:   15000,
+}
+
+const NOTIFY_TITLE = "YouTube"
+
+// notify shows a notification on the screen, if this type of notification is
+// enabled.
+func (s *session) notify(kind, title, message string) {
+	c := config.Get()
+	key := "apps.youtube.notify." + kind
+
+	enabled, err := c.GetBool(key, func() (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		logger.Warnln("could not read notification setting:", err)
+		enabled = true
+	}
+	if !enabled && kind != NOTIFY_APPROVAL {
+		return
+	}
+
+	displayTime, err := c.GetInt(key+".time", func() (int, error) {
+		return notifyDisplayTimes[kind], nil
+	})
+	if err != nil || displayTime <= 0 {
+		logger.Warnln("invalid notification display time for", kind)
+		displayTime = notifyDisplayTimes[kind]
+	}
+
+	s.mpMutex.Lock()
+	defer s.mpMutex.Unlock()
+	if s.mp != nil {
+		s.mp.Notify(title, message, time.Duration(displayTime)*time.Millisecond)
+	}
+}
+
+// notifyCast shows which video has been cast, and by whom if that is known.
+// The lounge doesn't tell which remote sent a command, so the remote is only
+// named when there is just one. It fetches the video title, so it shouldn't
+// be called from the main loop.
+func (s *session) notifyCast(videoIds []string, index int) {
+	title := "New video cast"
+	if remotes := s.remotes.list(); len(remotes) == 1 {
+		title = remoteLabel(remotes[0]) + " cast a video"
+	}
+
+	message := videoTitle(videoIds[index])
+	if len(videoIds) > 1 {
+		message += fmt.Sprintf(" (%d videos)", len(videoIds))
+	}
+
+	s.notify(NOTIFY_CAST, title, message)
+}
+
+// notifyApproval shows that a remote wants to connect, with the code to
+// approve it.
+func (s *session) notifyApproval(remote apps.Remote) {
+	code := s.remotes.code(remote.Id)
+	if code == "" {
+		return
+	}
+	s.notify(NOTIFY_APPROVAL, remoteLabel(remote)+" wants to connect", "Approve it on the kodicast home page with code "+code)
+}
+
+// remoteLabel returns a name for a remote to show to people.
+func remoteLabel(remote apps.Remote) string {
+	name := remote.Name
+	if name == "" {
+		name = remote.DeviceType
+	}
+	if name == "" {
+		name = "A remote"
+	}
+	if remote.User != "" {
+		name += " (" + remote.User + ")"
+	}
+	return name
+}
+
+// videoTitle looks up the title of a video, or returns the video ID when that
+// fails.
+func videoTitle(videoId string) string {
+	params := url.Values{}
+	params.Set("url", "https://www.youtube.com/watch?v="+videoId)
+	params.Set("format", "json")
+
+	response, err := httpGetBody("https://www.youtube.com/oembed?" + params.Encode())
+	if err != nil {
+		logger.Warnln("could not get video title:", err)
+		return videoId
+	}
+
+	info := struct {
+		Title string `json:"title"`
+	}{}
+	if err := json.Unmarshal(response, &info); err != nil || info.Title == "" {
+		logger.Warnln("could not get video title of", videoId)
+		return videoId
+	}
+	return info.Title
+}
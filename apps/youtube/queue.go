@@ -0,0 +1,97 @@
+package youtube
+
+import (
+	"time"
+)
+
+// Maximum time to wait before retrying to send messages. Sending is retried
+// indefinitely: messages are kept until they have been acknowledged.
+const MAX_SEND_RETRY_TIMEOUT = 30 * time.Second
+
+// Maximum number of unacknowledged messages. While the lounge can't be
+// reached, the oldest messages are dropped when more are queued.
+const MAX_QUEUE_LENGTH = 100
+
+// Commands for which only the latest message matters. An older message that
+// hasn't been sent yet is dropped when a newer one is queued.
+var coalescedCommands = map[string]bool{
+	"onStateChange":            true,
+	"onVolumeChanged":          true,
+	"onHasPreviousNextChanged": true,
+	"onPlaybackSpeedChanged":   true,
+	"onPlaylistModeChanged":    true,
+}
+
+// outgoingQueue holds outgoing messages until the server has acknowledged
+// them.
+//
+// Every message has an offset within the session (SID) it is sent in: the
+// `ofs` parameter of a batch is the offset of the first message in it. The
+// server ignores messages with an offset it has already seen, so a batch can
+// safely be sent again when it isn't known whether it arrived. When the
+// session changes, offsets start at zero again and all unacknowledged messages
+// are sent in the new session.
+//
+// The queue is only used from the sendMessages goroutine, so it isn't
+// synchronized.
+type outgoingQueue struct {
+	sid      string            // session the offsets belong to
+	acked    int               // offset of messages[0] within the session
+	attempts int               // messages at the head that have been sent at least once
+	messages []outgoingMessage // unacknowledged messages, in order
+}
+
+// push adds a message to the queue, replacing an older unsent message of the
+// same command if that command is coalesced.
+func (q *outgoingQueue) push(message outgoingMessage) {
+	if coalescedCommands[message.command] {
+		// Messages that may have reached the server already must be kept,
+		// otherwise the offsets of the following messages would shift.
+		for i := q.attempts; i < len(q.messages); i++ {
+			if q.messages[i].command == message.command {
+				q.messages = append(q.messages[:i], q.messages[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(q.messages) >= MAX_QUEUE_LENGTH && q.attempts < len(q.messages) {
+		logger.Warnln("outgoing queue is full, dropping message:", q.messages[q.attempts].command)
+		q.messages = append(q.messages[:q.attempts], q.messages[q.attempts+1:]...)
+	}
+	q.messages = append(q.messages, message)
+}
+
+// empty returns true when there are no unacknowledged messages.
+func (q *outgoingQueue) empty() bool {
+	return len(q.messages) == 0
+}
+
+// batch returns the offset and the messages to send in the given session.
+// The messages are considered attempted from now on.
+func (q *outgoingQueue) batch(sid string) (int, []outgoingMessage) {
+	if sid != q.sid {
+		// A new session: start counting from zero again.
+		q.sid = sid
+		q.acked = 0
+		q.attempts = 0
+	}
+
+	messages := make([]outgoingMessage, len(q.messages))
+	copy(messages, q.messages)
+	q.attempts = len(messages)
+	return q.acked, messages
+}
+
+// ack removes the first n messages after they have been accepted by the
+// server in the given session.
+func (q *outgoingQueue) ack(sid string, n int) {
+	if sid != q.sid || n > len(q.messages) {
+		return
+	}
+	q.messages = q.messages[n:]
+	q.acked += n
+	q.attempts -= n
+	if q.attempts < 0 {
+		q.attempts = 0
+	}
+}
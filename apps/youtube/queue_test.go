@@ -0,0 +1,150 @@
+package youtube
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// queueStep is a step in a queue test: push a message ("command" or
+// "command=value"), get a batch for a session and check its offset and
+// messages, or acknowledge n messages in a session.
+type queueStep struct {
+	op   string // push, batch or ack
+	arg  string // the message for push, the SID for batch and ack
+	n    int    // the expected offset for batch, the count for ack
+	want string // the expected messages for batch, comma separated
+}
+
+func pushMessage(q *outgoingQueue, message string) {
+	parts := strings.SplitN(message, "=", 2)
+	m := outgoingMessage{command: parts[0]}
+	if len(parts) == 2 {
+		m.args = map[string]string{"value": parts[1]}
+	}
+	q.push(m)
+}
+
+func formatMessages(messages []outgoingMessage) string {
+	var s []string
+	for _, m := range messages {
+		if value, ok := m.args["value"]; ok {
+			s = append(s, m.command+"="+value)
+		} else {
+			s = append(s, m.command)
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func TestOutgoingQueue(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		steps []queueStep
+	}{
+		{"ack", []queueStep{
+			{"push", "a", 0, ""},
+			{"push", "b", 0, ""},
+			{"batch", "S1", 0, "a,b"},
+			{"ack", "S1", 2, ""},
+			{"push", "c", 0, ""},
+			{"batch", "S1", 2, "c"},
+			{"ack", "S1", 1, ""},
+			{"batch", "S1", 3, ""},
+		}},
+		{"resend after a failure", []queueStep{
+			{"push", "a", 0, ""},
+			{"batch", "S1", 0, "a"},
+			// not acknowledged
+			{"push", "b", 0, ""},
+			{"batch", "S1", 0, "a,b"},
+			{"ack", "S1", 2, ""},
+			{"batch", "S1", 2, ""},
+		}},
+		{"ack of more messages than queued", []queueStep{
+			{"push", "a", 0, ""},
+			{"batch", "S1", 0, "a"},
+			{"ack", "S1", 2, ""},
+			{"batch", "S1", 0, "a"},
+		}},
+		{"ack from an old session", []queueStep{
+			{"push", "a", 0, ""},
+			{"push", "b", 0, ""},
+			{"batch", "S1", 0, "a,b"},
+			// reconnected before the ack arrived
+			{"batch", "S2", 0, "a,b"},
+			{"ack", "S1", 2, ""},
+			{"batch", "S2", 0, "a,b"},
+			{"ack", "S2", 2, ""},
+			{"batch", "S2", 2, ""},
+		}},
+		{"resend after a reconnect", []queueStep{
+			{"push", "a", 0, ""},
+			{"batch", "S1", 0, "a"},
+			{"ack", "S1", 1, ""},
+			{"push", "b", 0, ""},
+			{"push", "c", 0, ""},
+			{"batch", "S1", 1, "b,c"},
+			// the offsets start at zero in the new session
+			{"batch", "S2", 0, "b,c"},
+			{"ack", "S2", 2, ""},
+			{"push", "d", 0, ""},
+			{"batch", "S2", 2, "d"},
+		}},
+		{"coalescing", []queueStep{
+			{"push", "onStateChange=1", 0, ""},
+			{"push", "nowPlaying", 0, ""},
+			{"push", "onStateChange=2", 0, ""},
+			{"push", "onVolumeChanged=10", 0, ""},
+			{"push", "onVolumeChanged=20", 0, ""},
+			{"batch", "S1", 0, "nowPlaying,onStateChange=2,onVolumeChanged=20"},
+		}},
+		{"sent messages aren't coalesced", []queueStep{
+			{"push", "onStateChange=1", 0, ""},
+			{"batch", "S1", 0, "onStateChange=1"},
+			// may have arrived, so removing it would shift the offsets
+			{"push", "onStateChange=2", 0, ""},
+			{"push", "onStateChange=3", 0, ""},
+			{"batch", "S1", 0, "onStateChange=1,onStateChange=3"},
+			{"ack", "S1", 2, ""},
+			{"batch", "S1", 2, ""},
+		}},
+		{"other commands aren't coalesced", []queueStep{
+			{"push", "nowPlaying=1", 0, ""},
+			{"push", "nowPlaying=2", 0, ""},
+			{"batch", "S1", 0, "nowPlaying=1,nowPlaying=2"},
+		}},
+	} {
+		q := &outgoingQueue{}
+		for i, step := range test.steps {
+			switch step.op {
+			case "push":
+				pushMessage(q, step.arg)
+			case "ack":
+				q.ack(step.arg, step.n)
+			case "batch":
+				ofs, messages := q.batch(step.arg)
+				if got := formatMessages(messages); ofs != step.n || got != step.want {
+					t.Errorf("%s, step %d: got ofs %d with %q, expected ofs %d with %q", test.name, i, ofs, got, step.n, step.want)
+				}
+			}
+		}
+	}
+}
+
+func TestOutgoingQueueFull(t *testing.T) {
+	q := &outgoingQueue{}
+	pushMessage(q, "first")
+	q.batch("S1")
+	for i := 0; i < MAX_QUEUE_LENGTH; i++ {
+		pushMessage(q, "m="+strconv.Itoa(i))
+	}
+	ofs, messages := q.batch("S1")
+	if ofs != 0 || len(messages) != MAX_QUEUE_LENGTH {
+		t.Fatalf("got ofs %d with %d messages", ofs, len(messages))
+	}
+	// The message that has been sent is kept, the oldest unsent one dropped.
+	if got := formatMessages(messages[:2]); got != "first,m=1" {
+		t.Errorf("queue starts with %s", got)
+	}
+}
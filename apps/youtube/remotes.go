@@ -0,0 +1,222 @@
+package youtube
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sargo/kodicast/apps"
+)
+
+// remoteList keeps track of the remotes that are connected to the lounge.
+type remoteList struct {
+	mutex     sync.Mutex
+	remotes   map[string]apps.Remote // key is the remote ID
+	policy    accessPolicy
+	decisions map[string]Access // remotes approved or denied during this run
+	codes     map[string]*approvalCode
+}
+
+// approvalCode is the code that approves or denies a pending remote. It is
+// only shown on the screen, so only people who can see the TV can approve
+// remotes.
+type approvalCode struct {
+	code     string
+	attempts int // wrong codes entered
+}
+
+// Number of wrong codes after which a remote can't be approved anymore, until
+// it connects again.
+const MAX_APPROVAL_ATTEMPTS = 3
+
+var (
+	errNoSuchRemote    = errors.New("no such remote")
+	errWrongCode       = errors.New("wrong approval code")
+	errNotPending      = errors.New("remote is not waiting for approval")
+	errApprovalBlocked = errors.New("too many wrong approval codes, connect the remote again for a new code")
+)
+
+// newRemote converts a device as announced by the lounge to a Remote.
+func newRemote(device remoteConnected, connectedAt time.Time) apps.Remote {
+	deviceType := device.ClientName
+	if deviceType == "" {
+		deviceType = device.App
+	}
+	return apps.Remote{
+		Id:          device.Id,
+		Name:        device.Name,
+		User:        device.User,
+		DeviceType:  deviceType,
+		ConnectedAt: connectedAt,
+	}
+}
+
+// connect adds a remote. It returns false when the remote was already
+// connected.
+func (rl *remoteList) connect(device remoteConnected) (apps.Remote, bool) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if rl.remotes == nil {
+		rl.remotes = make(map[string]apps.Remote)
+	}
+
+	remote, ok := rl.remotes[device.Id]
+	if ok {
+		// keep the original connection time
+		remote = newRemote(device, remote.ConnectedAt)
+	} else {
+		remote = newRemote(device, time.Now())
+	}
+	rl.remotes[device.Id] = remote
+	access := rl.checkAccess(remote)
+	remote.Access = access.String()
+	if access == ACCESS_PENDING && !ok {
+		rl.newCode(remote.Id)
+	}
+	return remote, !ok
+}
+
+// disconnect removes a remote. It returns false when the remote wasn't
+// connected.
+func (rl *remoteList) disconnect(id string) (apps.Remote, bool) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	remote, ok := rl.remotes[id]
+	delete(rl.remotes, id)
+	return remote, ok
+}
+
+// reset rebuilds the list from the devices in a loungeStatus message, which is
+// sent on every (re)connect. Remotes that were already known keep their
+// connection time. It returns the new remotes that have to be approved.
+func (rl *remoteList) reset(devices []remoteConnected) []apps.Remote {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	remotes := make(map[string]apps.Remote)
+	var pending []apps.Remote
+	now := time.Now()
+	for _, device := range devices {
+		if device.Type != "REMOTE_CONTROL" || device.Id == "" {
+			// this is the screen itself
+			continue
+		}
+		connectedAt := now
+		remote, known := rl.remotes[device.Id]
+		if known {
+			connectedAt = remote.ConnectedAt
+		}
+		remote = newRemote(device, connectedAt)
+		remotes[device.Id] = remote
+		if access := rl.checkAccess(remote); access == ACCESS_PENDING && !known {
+			remote.Access = access.String()
+			rl.newCode(remote.Id)
+			pending = append(pending, remote)
+		}
+	}
+	rl.remotes = remotes
+	return pending
+}
+
+// list returns all connected remotes, the first connected remote first.
+func (rl *remoteList) list() []apps.Remote {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	remotes := make([]apps.Remote, 0, len(rl.remotes))
+	for _, remote := range rl.remotes {
+		remote.Access = rl.checkAccess(remote).String()
+		remotes = append(remotes, remote)
+	}
+	sort.Slice(remotes, func(i, j int) bool {
+		if remotes[i].ConnectedAt.Equal(remotes[j].ConnectedAt) {
+			return remotes[i].Id < remotes[j].Id
+		}
+		return remotes[i].ConnectedAt.Before(remotes[j].ConnectedAt)
+	})
+	return remotes
+}
+
+// checkAccess returns the access of a remote. The mutex must be held.
+func (rl *remoteList) checkAccess(remote apps.Remote) Access {
+	if access, ok := rl.decisions[remote.Id]; ok {
+		return access
+	}
+	return rl.policy.check(remote)
+}
+
+// access returns the access of a connected remote.
+func (rl *remoteList) access(id string) Access {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	remote, ok := rl.remotes[id]
+	if !ok {
+		return ACCESS_ALLOWED
+	}
+	return rl.checkAccess(remote)
+}
+
+// setAccess approves or denies a pending remote for the rest of this run. The
+// code must be the approval code that was shown for it.
+func (rl *remoteList) setAccess(id string, access Access, code string) (apps.Remote, error) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	remote, ok := rl.remotes[id]
+	if !ok {
+		return remote, errNoSuchRemote
+	}
+	expected := rl.codes[id]
+	if expected == nil {
+		if rl.checkAccess(remote) != ACCESS_PENDING {
+			return remote, errNotPending
+		}
+		return remote, errApprovalBlocked
+	}
+	if code != expected.code {
+		expected.attempts++
+		if expected.attempts >= MAX_APPROVAL_ATTEMPTS {
+			delete(rl.codes, id)
+		}
+		return remote, errWrongCode
+	}
+	delete(rl.codes, id)
+
+	if rl.decisions == nil {
+		rl.decisions = make(map[string]Access)
+	}
+	rl.decisions[id] = access
+	remote.Access = access.String()
+	return remote, nil
+}
+
+// code returns the approval code of a pending remote, or an empty string.
+func (rl *remoteList) code(id string) string {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if code := rl.codes[id]; code != nil {
+		return code.code
+	}
+	return ""
+}
+
+// newCode generates a new approval code for a remote. The mutex must be held.
+func (rl *remoteList) newCode(id string) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		logger.Errln("could not generate approval code:", err)
+		return
+	}
+	if rl.codes == nil {
+		rl.codes = make(map[string]*approvalCode)
+	}
+	rl.codes[id] = &approvalCode{code: fmt.Sprintf("%06d", n)}
+}
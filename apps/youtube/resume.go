@@ -0,0 +1,151 @@
+package youtube
+
+import (
+	"time"
+
+	"github.com/sargo/kodicast/apps/youtube/mp"
+	"github.com/sargo/kodicast/config"
+)
+
+// # Resuming sessions
+//
+// When kodicast shuts down, the lounge session and the queue are saved in the
+// config file. On the next start the session is resumed with the OSID/OAID
+// parameters, so remotes stay connected across a quick restart or upgrade.
+// YouTube forgets sessions after a while, so old sessions aren't resumed.
+
+const SESSION_CONFIG_KEY = "apps.youtube.session"
+
+// Maximum age of a saved session that will still be resumed.
+const RESUME_TIMEOUT = 10 * time.Minute
+
+// savedSession is the state of a YouTube app run that is saved on shutdown.
+type savedSession struct {
+	Saved       time.Time
+	LoungeToken string
+	Sid         string
+	Gsessionid  string
+	Aid         int32
+	Rid         int
+	Playlist    []string
+	Index       int
+	Position    time.Duration
+	State       mp.State
+	ListId      string
+}
+
+// keepVideo returns the video that was playing, which doesn't have to be
+// started again if the media player is still playing it.
+func (saved *savedSession) keepVideo() string {
+	if saved == nil || len(saved.Playlist) == 0 || saved.Index < 0 || saved.Index >= len(saved.Playlist) {
+		return ""
+	}
+	switch saved.State {
+	case mp.STATE_PLAYING, mp.STATE_PAUSED, mp.STATE_BUFFERING:
+		return saved.Playlist[saved.Index]
+	}
+	return ""
+}
+
+// Suspend stops the app, but saves the session so it can be resumed after a
+// restart.
+func (yt *YouTube) Suspend() {
+	yt.sessionMutex.Lock()
+	s := yt.session
+	yt.sessionMutex.Unlock()
+
+	if s == nil {
+		return
+	}
+
+	saved := savedSession{
+		Saved: time.Now(),
+	}
+
+	s.sendMutex.Lock()
+	if s.sessionReady {
+		saved.LoungeToken = s.loungeToken
+		saved.Sid = s.sid
+		saved.Gsessionid = s.gsessionid
+		saved.Aid = s.aid
+		saved.Rid = s.rid.Number()
+	}
+	s.sendMutex.Unlock()
+
+	if player := s.player(); player != nil {
+		ps := player.GetPlaylist()
+		saved.Playlist = ps.Playlist
+		saved.Index = ps.Index
+		saved.Position = ps.Position
+		saved.State = ps.State
+		saved.ListId = ps.ListId
+	}
+
+	yt.endSession(s)
+
+	// Wait for the player to quit, so it won't be stopped halfway.
+	<-s.done
+
+	logger.Println("saving session", saved.Sid)
+	if err := config.Get().SetValue(SESSION_CONFIG_KEY, saved); err != nil {
+		logger.Warnln("could not save session:", err)
+	}
+}
+
+// Resume starts the app with the session saved by Suspend, if there is a
+// recent one. A saved session is only used once.
+func (yt *YouTube) Resume() bool {
+	if yt.Running() {
+		return false
+	}
+
+	c := config.Get()
+	saved := &savedSession{}
+	ok, err := c.GetValue(SESSION_CONFIG_KEY, saved)
+	if err != nil {
+		logger.Warnln("could not load saved session:", err)
+	}
+	if !ok || err != nil {
+		return false
+	}
+	c.Delete(SESSION_CONFIG_KEY)
+
+	if age := time.Since(saved.Saved); age > RESUME_TIMEOUT || age < 0 {
+		logger.Println("not resuming session saved", age, "ago")
+		return false
+	}
+
+	logger.Println("resuming session", saved.Sid)
+	yt.start(nil, saved)
+	return true
+}
+
+// restoreSession restores the lounge session from a saved session, before
+// connecting.
+func (s *session) restoreSession(saved *savedSession) {
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+
+	s.loungeToken = saved.LoungeToken
+	s.sid = saved.Sid
+	s.gsessionid = saved.Gsessionid
+	s.aid = saved.Aid
+	if saved.Sid != "" {
+		s.rid.Set(saved.Rid)
+	}
+}
+
+// restoreQueue restores the queue from a saved session, once the media player
+// is running.
+func (s *session) restoreQueue(saved *savedSession) {
+	if len(saved.Playlist) == 0 || saved.Index < 0 || saved.Index >= len(saved.Playlist) {
+		return
+	}
+
+	if saved.keepVideo() != "" {
+		// Kodi may still be playing it.
+		s.mp.ResumePlaystate(saved.Playlist, saved.Index, saved.Position, saved.ListId)
+	} else {
+		s.mp.UpdatePlaylist(saved.Playlist, saved.ListId)
+	}
+}
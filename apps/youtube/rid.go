@@ -36,3 +36,20 @@ func (rid *RandomID) Next() int {
 	rid.number++
 	return rid.number
 }
+
+// Number returns the last RID that was handed out, so the counter can be
+// continued later with Set.
+func (rid *RandomID) Number() int {
+	rid.mutex.Lock()
+	defer rid.mutex.Unlock()
+
+	return rid.number
+}
+
+// Set continues the counter from a previously saved number.
+func (rid *RandomID) Set(number int) {
+	rid.mutex.Lock()
+	defer rid.mutex.Unlock()
+
+	rid.number = number
+}
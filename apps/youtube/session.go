@@ -0,0 +1,76 @@
+package youtube
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sargo/kodicast/apps/youtube/mp"
+)
+
+// A session is a single run of the YouTube app, from Start until Quit. See
+// "Preventing race conditions & leaks" in youtube.go.
+type session struct {
+	app    *YouTube
+	ctx    context.Context // cancelled when this run ends
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the media player of this run has quit
+
+	systemName string
+	uuid       string
+	rid        *RandomID // generates random numbers for outgoing messages
+	connection connectionStatus
+	remotes    remoteList
+
+	// The lounge session, guarded by sendMutex.
+	sendMutex     sync.Mutex
+	loungeToken   string
+	sid           string
+	gsessionid    string
+	aid           int32
+	sessionReady  bool          // true when sid and gsessionid belong to the current lounge session
+	sessionChange chan struct{} // signals sendMessages a new lounge session is ready
+
+	mp      *mp.MediaPlayer
+	mpMutex sync.Mutex // to quit the player safely
+
+	incomingMessages chan incomingMessage
+	outgoingMessages chan outgoingMessage
+	pairingCodes     chan string
+}
+
+// newSession returns a new session for a run of the app.
+func newSession(app *YouTube) *session {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &session{
+		app:              app,
+		ctx:              ctx,
+		cancel:           cancel,
+		done:             make(chan struct{}),
+		systemName:       app.systemName,
+		rid:              NewRandomID(),
+		remotes:          remoteList{policy: loadAccessPolicy()},
+		sessionChange:    make(chan struct{}, 1),
+		incomingMessages: make(chan incomingMessage, 5),
+		outgoingMessages: make(chan outgoingMessage, 5),
+		pairingCodes:     make(chan string),
+	}
+}
+
+// running returns true until this run of the app has been stopped.
+func (s *session) running() bool {
+	return s.ctx.Err() == nil
+}
+
+// quit stops this run of the app. It may be called multiple times.
+func (s *session) quit() {
+	s.app.endSession(s)
+}
+
+// addPairingCode hands a pairing code to sendMessages to be registered. It
+// doesn't block when the session is stopped in the meantime.
+func (s *session) addPairingCode(pairingCode string) {
+	select {
+	case s.pairingCodes <- pairingCode:
+	case <-s.ctx.Done():
+	}
+}
@@ -0,0 +1,161 @@
+package youtube
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// # Connection supervisor
+//
+// The connection to the lounge is kept alive by a supervisor (connect) that
+// never gives up while the app is running. When YouTube can't be reached, the
+// app stays in the "offline" state: the media player keeps working, and the
+// supervisor probes the lounge with a jittered exponential backoff until the
+// network is back. A long-poll request that stops receiving data (not even the
+// periodic noop messages) is aborted after READ_TIMEOUT and reopened.
+
+// Maximum time to wait between two connection attempts.
+const MAX_RETRY_TIMEOUT = 2 * time.Minute
+
+// Time after which a silent message channel is considered hanging. YouTube
+// sends a noop message every 30 seconds or so.
+const READ_TIMEOUT = 90 * time.Second
+
+// ConnectionState is the state of the connection to the lounge.
+type ConnectionState int
+
+const (
+	CONNECTION_STOPPED ConnectionState = iota
+	CONNECTION_CONNECTING
+	CONNECTION_ONLINE
+	CONNECTION_OFFLINE
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case CONNECTION_STOPPED:
+		return "stopped"
+	case CONNECTION_CONNECTING:
+		return "connecting"
+	case CONNECTION_ONLINE:
+		return "online"
+	case CONNECTION_OFFLINE:
+		return "offline"
+	default:
+		return "unknown"
+	}
+}
+
+// connectionStatus keeps track of the connection state, and reports every
+// transition.
+type connectionStatus struct {
+	mutex sync.Mutex
+	state ConnectionState
+	since time.Time
+	err   error // last error while offline
+}
+
+// set changes the connection state. The error is only used for the offline
+// state, and describes why the lounge can't be reached.
+func (cs *connectionStatus) set(state ConnectionState, err error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if cs.state == state {
+		cs.err = err
+		return
+	}
+
+	duration := ""
+	if !cs.since.IsZero() {
+		duration = " after " + (time.Since(cs.since) / time.Second * time.Second).String()
+	}
+	switch {
+	case state == CONNECTION_OFFLINE:
+		logger.Warnf("lounge connection: %s -> %s%s: %s\n", cs.state, state, duration, err)
+	case cs.state == CONNECTION_OFFLINE:
+		logger.Warnf("lounge connection: %s -> %s%s\n", cs.state, state, duration)
+	default:
+		logger.Printf("lounge connection: %s -> %s%s\n", cs.state, state, duration)
+	}
+
+	cs.state = state
+	cs.since = time.Now()
+	cs.err = err
+}
+
+// get returns the current connection state, when it was entered and the
+// error that caused it (for the offline state).
+func (cs *connectionStatus) get() (ConnectionState, time.Time, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	return cs.state, cs.since, cs.err
+}
+
+// backoff calculates an exponentially increasing timeout with random jitter,
+// so a lot of devices don't all hit the server at the same moment after an
+// outage.
+type backoff struct {
+	retries int
+	max     time.Duration
+}
+
+// next returns the time to wait before the next attempt.
+func (b *backoff) next() time.Duration {
+	b.retries++
+	timeout := time.Duration(b.retries*b.retries) * RETRY_TIMEOUT * time.Millisecond
+	if timeout > b.max || timeout <= 0 {
+		timeout = b.max
+	}
+	// between 50% and 150% of the timeout
+	return timeout/2 + time.Duration(rand.Int63n(int64(timeout)))
+}
+
+// reset is called after a successful attempt.
+func (b *backoff) reset() {
+	b.retries = 0
+}
+
+var errReadTimeout = errors.New("no data received on message channel for " + READ_TIMEOUT.String())
+
+// idleTimeoutReader closes the underlying reader when no data has arrived for
+// some time, so a hanging long-poll request doesn't block forever.
+type idleTimeoutReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	expired int32 // set atomically by the timer
+}
+
+func newIdleTimeoutReader(body io.ReadCloser, timeout time.Duration) *idleTimeoutReader {
+	r := &idleTimeoutReader{
+		body:    body,
+		timeout: timeout,
+	}
+	r.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&r.expired, 1)
+		body.Close()
+	})
+	return r
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if atomic.LoadInt32(&r.expired) != 0 {
+		return n, errReadTimeout
+	}
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+func (r *idleTimeoutReader) Close() error {
+	r.timer.Stop()
+	return r.body.Close()
+}
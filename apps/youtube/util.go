@@ -5,11 +5,33 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"time"
 )
 
+// httpClient is used for normal requests to YouTube.
+var httpClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// streamClient is used for the long-running message channel, so it doesn't
+// have a timeout for the whole request. Stalled connections are detected while
+// reading the response instead.
+var streamClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: READ_TIMEOUT,
+	},
+}
+
 // zx generates a random string of bytes that is 12 characters long.
 // It is being used by some (unofficial) Google APIs.
 func zx() []byte {
@@ -25,7 +47,7 @@ func zx() []byte {
 // array, or an error on HTTP protocol erroros or when the HTTP status code
 // isn't 200.
 func httpGetBody(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+	resp, err := httpClient.Get(url)
 	if err != nil {
 		return nil, err
 	}
@@ -37,7 +59,7 @@ func httpGetBody(url string) ([]byte, error) {
 // httpPostFormBody is similar to httpGetBody, but does a POST request with
 // the supplied values.
 func httpPostFormBody(url string, values url.Values) ([]byte, error) {
-	resp, err := http.PostForm(url, values)
+	resp, err := httpClient.PostForm(url, values)
 	if err != nil {
 		return nil, err
 	}
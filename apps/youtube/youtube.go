@@ -3,9 +3,9 @@ package youtube
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -13,6 +13,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/sargo/kodicast/apps"
 	"github.com/sargo/kodicast/apps/youtube/mp"
 	"github.com/sargo/kodicast/config"
 	"github.com/sargo/kodicast/log"
@@ -21,10 +22,8 @@ import (
 
 var logger = log.New("youtube", "log YouTube app")
 
-// How often a new connection attempt should be done.
-// With a starting delay of 500ms that exponentially increases, this is about 5
-// minutes.
-const RETRIES = 25
+// Base URL of the lounge API, which remotes and screens talk through.
+var loungeURL = "https://www.youtube.com/api/lounge"
 
 // Initial retry timeout in milliseconds. This timeout increases exponentially.
 const RETRY_TIMEOUT = 500
@@ -32,12 +31,16 @@ const RETRY_TIMEOUT = 500
 // # Preventing race conditions & leaks
 //
 // There were a *lot* race conditions, but most have been fixed by now, using a
-// new design. Many race conditions were triggered when Stop() was called.
-// Stop() will hold a mutex for the `running` variable. As will the part
-// receiving messages. As soon as Stop() is called, no more new messages will be
-// received and run() will be stopped using a separate channel (`runQuit`).
-// The overall exiting order looks like this:
-//     Stop() + bind() -> run() -> backend (via player) -> player -> playerEvents -> outgoingMessages
+// new design. Every run of the app (from Start to Quit) gets its own session
+// object with all state of that run, and a context that is cancelled when the
+// run ends. Goroutines only ever touch their own session, so when the app is
+// quit and started again quickly, goroutines of the old run that are still
+// shutting down can't clash with the new run. A new run waits for the media
+// player of the previous run to quit before starting its own.
+//
+// As soon as Quit() is called, no more new messages will be received and run()
+// will be stopped via the context. The overall exiting order looks like this:
+//     Quit() + bind() -> run() -> backend (via player) -> player -> playerEvents -> outgoingMessages
 //
 // These are also all goroutines that will exist (a few possible exceptions
 // aside that will manage their lifetime themselves).
@@ -50,38 +53,22 @@ const RETRY_TIMEOUT = 500
 // to be very lightweight (not running Chrome).
 type YouTube struct {
 	systemName   string
-	running      bool
-	runningMutex sync.Mutex
-	// TODO split everything under here into a separate struct, so re-running
-	// the app won't clash with the previous run.
-	rid              *RandomID // generates random numbers for outgoing messages
-	runQuit          chan struct{}
-	uuid             string
-	loungeToken      string
-	sendMutex        sync.Mutex
-	sid              string
-	gsessionid       string
-	aid              int32 // int32 is thread-safe on ARM and Intel processors
-	mp               *mp.MediaPlayer
-	mpMutex          sync.Mutex // to quit the player safely
-	incomingMessages chan incomingMessage
-	outgoingMessages chan outgoingMessage
-	pairingCodes     chan string
+	sessionMutex sync.Mutex
+	session      *session // the current run, nil when the app isn't running
+	lastSession  *session // the last run, which may still be shutting down
 }
 
 // JSON data structures for get_lounge_token_batch.
 type loungeTokenBatchJson struct {
-	Screens []screenTokenJson "screens"
+	Screens []screenTokenJson `json:"screens"`
 }
 type screenTokenJson struct {
-	ScreenId    string "screenId"
-	Expiration  int64  "expiration"
-	LoungeToken string "loungeToken"
+	ScreenId    string `json:"screenId"`
+	Expiration  int64  `json:"expiration"`
+	LoungeToken string `json:"loungeToken"`
 }
 
-// JSON data structure for messages received over the message channel.
-type incomingMessagesJson []incomingMessageJson
-type incomingMessageJson []interface{}
+// A single message received over the message channel.
 type incomingMessage struct {
 	index   int
 	command string
@@ -98,7 +85,6 @@ type outgoingMessage struct {
 func New(systemName string) *YouTube {
 	yt := YouTube{}
 	yt.systemName = systemName
-	yt.runQuit = make(chan struct{})
 	return &yt
 }
 
@@ -109,46 +95,59 @@ func (yt *YouTube) FriendlyName() string {
 // Start starts the YouTube app asynchronously.
 // Attaches a new device if the app has already started.
 func (yt *YouTube) Start(postData string) {
-	yt.runningMutex.Lock()
-	running := yt.running
-	yt.runningMutex.Unlock()
-
 	arguments, err := url.ParseQuery(postData)
-	// TODO proper error handling
 	if err != nil {
-		panic(err)
+		logger.Warnln("could not parse launch parameters:", err)
 	}
 
-	if running {
+	yt.sessionMutex.Lock()
+	s := yt.session
+	yt.sessionMutex.Unlock()
+
+	if s != nil {
 		// Only use `pairingCode`, ignore `v` and `t` arguments.
-		yt.pairingCodes <- arguments["pairingCode"][0]
+		if pairingCode := arguments.Get("pairingCode"); pairingCode != "" {
+			s.addPairingCode(pairingCode)
+		}
 
 	} else {
-		yt.start(arguments)
+		yt.start(arguments, nil)
 	}
 }
 
 // Quit stops this app if it is running.
 func (yt *YouTube) Quit() {
-	// shut down everything about this app
-	yt.runningMutex.Lock()
-	defer yt.runningMutex.Unlock()
+	yt.sessionMutex.Lock()
+	s := yt.session
+	yt.sessionMutex.Unlock()
 
-	if !yt.running {
-		return
+	if s != nil {
+		yt.endSession(s)
+	}
+}
+
+// endSession stops the given run of the app. Nothing happens when it has
+// already been stopped.
+func (yt *YouTube) endSession(s *session) {
+	yt.sessionMutex.Lock()
+	if yt.session == s {
+		yt.session = nil
 	}
-	yt.running = false
+	yt.sessionMutex.Unlock()
 
-	yt.runQuit <- struct{}{}
+	// shut down everything about this run
+	s.cancel()
 }
 
-func (yt *YouTube) init(arguments url.Values, stateChange chan mp.StateChange) {
+func (s *session) init(arguments url.Values, stateChange chan mp.StateChange, events chan mp.Event, resume *savedSession) {
 	var err error
 
-	yt.rid = NewRandomID()
+	if resume != nil {
+		s.restoreSession(resume)
+	}
 
 	c := config.Get()
-	yt.uuid, err = c.GetString("apps.youtube.uuid", func() (string, error) {
+	s.uuid, err = c.GetString("apps.youtube.uuid", func() (string, error) {
 		uuid, err := uuid.NewV4()
 		if err != nil {
 			return "", err
@@ -158,61 +157,107 @@ func (yt *YouTube) init(arguments url.Values, stateChange chan mp.StateChange) {
 	if err != nil {
 		panic(err)
 	}
-	yt.incomingMessages = make(chan incomingMessage, 5)
-	yt.outgoingMessages = make(chan outgoingMessage, 5)
-
-	// This is a goroutine that receives messages from YouTube and starts a
-	// goroutine to send messages to YouTube.
-	go yt.connect()
 
-	if pairingCodes, ok := arguments["pairingCode"]; ok {
-		go func() {
-			yt.pairingCodes <- pairingCodes[0]
-		}()
+	// Start the media player before connecting to the lounge: a video
+	// launched via DIAL should play even when the lounge can't be reached.
+	// Remotes will attach once the connection is up.
+	provider, autoplay := loadAutoplay()
+	player := mp.New(stateChange, events, provider, autoplay, resume.keepVideo())
+	var audioLanguages []string
+	if _, err := config.Get().GetValue("apps.youtube.audio.languages", &audioLanguages); err != nil {
+		logger.Warnln("could not read preferred audio languages:", err)
 	}
+	player.SetAudioLanguages(audioLanguages)
+	player.SetStopPolicy(loadStopPolicy())
+	s.mpMutex.Lock()
+	s.mp = player
+	s.mpMutex.Unlock()
+
+	if resume != nil {
+		s.restoreQueue(resume)
+	}
+
+	if videoId := arguments.Get("v"); videoId != "" {
+		position := time.Duration(0)
+		if t := arguments.Get("t"); t != "" {
+			position, err = parseTime(t)
+			if err != nil {
+				logger.Warnln("could not parse start time of launched video:", err)
+				position = 0
+			}
+		}
 
-	yt.mp = mp.New(stateChange)
+		logger.Println("playing launched video:", videoId, position)
+		s.mp.SetPlaystate([]string{videoId}, 0, position, "")
+	}
 
-	video, ok := arguments["v"]
-	if ok && len(video[0]) > 0 {
-		videoId := video[0]
+	// This is a goroutine that receives messages from YouTube and starts a
+	// goroutine to send messages to YouTube.
+	go s.connect()
 
-		position, err := time.ParseDuration(arguments["t"][0] + "s")
-		if err != nil {
-			panic(err)
-		}
+	if pairingCode := arguments.Get("pairingCode"); pairingCode != "" {
+		go s.addPairingCode(pairingCode)
+	}
+}
 
-		yt.mp.SetPlaystate([]string{videoId}, 0, position, "")
+// loadStopPolicy reads what to do when the user stops a video on Kodi itself,
+// from "apps.youtube.stop": "quit" ends the session, "keep" keeps it and
+// "next" plays the next video.
+func loadStopPolicy() mp.StopPolicy {
+	value, err := config.Get().GetString("apps.youtube.stop", func() (string, error) {
+		return mp.STOP_QUIT.String(), nil
+	})
+	if err != nil {
+		logger.Warnln("could not read stop policy:", err)
+	}
+	policy, ok := mp.ParseStopPolicy(value)
+	if !ok {
+		logger.Warnln("unknown stop policy:", value)
 	}
+	return policy
 }
 
-func (yt *YouTube) start(arguments url.Values) {
-	yt.runningMutex.Lock()
-	defer yt.runningMutex.Unlock()
-	yt.running = true
+func (yt *YouTube) start(arguments url.Values, resume *savedSession) {
+	yt.sessionMutex.Lock()
+	defer yt.sessionMutex.Unlock()
+
+	if yt.session != nil {
+		return
+	}
 
-	// Of all values, this one should not be initialized inside a goroutine
-	// because that's a race condition.
-	yt.pairingCodes = make(chan string)
+	previousRun := yt.lastSession
+	s := newSession(yt)
+	yt.session = s
+	yt.lastSession = s
 
-	go yt.run(arguments)
+	go s.run(arguments, resume, previousRun)
 }
 
-func (yt *YouTube) run(arguments url.Values) {
+func (s *session) run(arguments url.Values, resume *savedSession, previousRun *session) {
+	defer close(s.done)
+
+	if previousRun != nil {
+		// Both runs would control the same player.
+		<-previousRun.done
+	}
+	if !s.running() {
+		return
+	}
+
 	stateChange := make(chan mp.StateChange)
-	volumeChan := make(chan int, 1)
+	events := make(chan mp.Event)
 	playlistChan := make(chan mp.PlaylistState)
 	nowPlayingChan := make(chan mp.PlaylistState, 1)
 	// nowPlayingChan will ask for a signal inside playerEvents.
 
 	// This goroutine handles all signals coming from the media player.
-	go yt.playerEvents(stateChange, volumeChan, playlistChan, nowPlayingChan)
+	go s.playerEvents(stateChange, events, playlistChan, nowPlayingChan)
 
-	yt.init(arguments, stateChange)
+	s.init(arguments, stateChange, events, resume)
 
 	for {
 		select {
-		case message := <-yt.incomingMessages:
+		case message := <-s.incomingMessages:
 
 			// Only print a message for less-verbose output.
 			switch message.command {
@@ -221,413 +266,652 @@ func (yt *YouTube) run(arguments url.Values) {
 				logger.Println("command:", message.index, message.command, message.args)
 			}
 
-			switch message.command {
-			case "remoteConnected":
-				logger.Printf("Remote connected: %s (%s)\n", message.args["name"], message.args["user"])
-			case "remoteDisconnected":
-				logger.Printf("Remote disconnected: %s (%s)\n", message.args["name"], message.args["user"])
-			case "loungeStatus":
-				// pass
-				break
-			case "getVolume":
-				yt.mp.RequestVolume(volumeChan)
-			case "setVolume":
-				delta, ok := message.args["delta"]
-				if ok {
-					delta, err := strconv.Atoi(delta)
-					if err != nil {
-						logger.Warnln("volume delta could not be parsed:", err)
-						break
-					}
-					yt.mp.ChangeVolume(delta, volumeChan)
+			command, err := decodeCommand(message)
+			if err != nil {
+				if err == errUnknownCommand {
+					logger.Println("unknown command:", message.command)
 				} else {
-					volume, err := strconv.Atoi(message.args["volume"])
-					if err != nil {
-						logger.Warnln("volume could not be parsed:", err)
-						break
+					logger.Warnf("could not decode %s: %s\n", message.command, err)
+				}
+				break
+			}
+
+			if remote, ok := s.remotes.permits(command); !ok {
+				logger.Warnf("dropping %s: remote %s (%s) is %s\n", message.command, remote.Name, remote.Id, remote.Access)
+				break
+			}
+
+			switch command := command.(type) {
+			case remoteConnected:
+				logger.Printf("Remote connected: %s (%s)\n", command.Name, command.User)
+				if remote, ok := s.remotes.connect(command); ok {
+					switch s.remotes.access(remote.Id) {
+					case ACCESS_PENDING:
+						s.notifyApproval(remote)
+					case ACCESS_DENIED:
+						logger.Warnf("Remote %s (%s) is denied\n", remote.Name, remote.Id)
+					default:
+						s.notify(NOTIFY_CONNECT, NOTIFY_TITLE, remoteLabel(remote)+" connected")
 					}
-					yt.mp.SetVolume(volume, volumeChan)
 				}
-			case "getPlaylist":
-				yt.mp.RequestPlaylist(playlistChan)
-			case "setPlaylist":
-				playlist := strings.Split(message.args["videoIds"], ",")
-
-				index, err := strconv.Atoi(message.args["currentIndex"])
-				if err != nil {
-					logger.Warnln("currentIndex could not be parsed:", err)
-					break
+				s.mp.RequestAutoplayMode()
+				s.mp.RequestQueue()
+				s.mp.RequestRate()
+				s.mp.RequestPlaylistMode()
+			case remoteDisconnected:
+				logger.Printf("Remote disconnected: %s (%s)\n", command.Name, command.User)
+				if remote, ok := s.remotes.disconnect(command.Id); ok {
+					s.notify(NOTIFY_DISCONNECT, NOTIFY_TITLE, remoteLabel(remote)+" disconnected")
 				}
-
-				position, err := time.ParseDuration(message.args["currentTime"] + "s")
-				if err != nil {
-					logger.Warnln("currentTime could not be parsed:", err)
-					break
+			case loungeStatus:
+				for _, remote := range s.remotes.reset(command.Devices) {
+					s.notifyApproval(remote)
 				}
-
-				if index < 0 || len(playlist) == 0 || index >= len(playlist) {
-					logger.Warnln("setPlaylist got invalid parameters")
-					break
+				s.mp.RequestAutoplayMode()
+				s.mp.RequestQueue()
+				s.mp.RequestRate()
+				s.mp.RequestPlaylistMode()
+			case getVolume:
+				s.mp.RequestVolume()
+			case setVolume:
+				if command.HasMuted {
+					s.mp.SetMute(command.Muted)
 				}
-				logger.Println("SetPlaystate:", playlist, index, position, message.args["listId"])
-				yt.mp.SetPlaystate(playlist, index, position, message.args["listId"])
-			case "updatePlaylist":
-				playlist := strings.Split(message.args["videoIds"], ",")
-				yt.mp.UpdatePlaylist(playlist, message.args["listId"])
-				yt.outgoingMessages <- outgoingMessage{"confirmPlaylistUpdate", map[string]string{"updated": "true"}}
-			case "setVideo":
-				videoId := message.args["videoId"]
-				position, err := time.ParseDuration(message.args["currentTime"] + "s")
-				if err != nil {
-					logger.Warnln("could not parse currentTime:", err)
-					break
+				if command.HasDelta {
+					s.mp.ChangeVolume(command.Delta)
+				} else if command.HasVolume {
+					s.mp.SetVolume(command.Volume)
 				}
-
-				yt.mp.SetVideo(videoId, position)
-			case "getNowPlaying":
-				yt.mp.RequestPlaylist(nowPlayingChan)
-			case "getSubtitlesTrack":
-				// Just send out an empty message. It looks like the Android
-				// YouTube client doesn't care too much about this message
-				// anyway. Usually `getSubtitlesTrack` is only sent on
-				// connection, and not asked (or sent) when switching videos,
-				// which is kinda odd to me. When a video is playing while this
-				// message is sent, the videoId is sent with it, and some other
-				// stuff like `languageCode` to indicate the currently playing
-				// subtitles track. Again, this is not updated when the video
-				// changes.
-				// No subtitles are visible anyway on a headless Chromecast
-				// installation, and the Android client doesn't seem to change
-				// it's behavior much when leaving out this message.
-				yt.outgoingMessages <- outgoingMessage{"onSubtitlesTrackChanged", map[string]string{"videoId": ""}}
-			case "pause":
-				yt.mp.Pause()
-			case "play":
-				yt.mp.Play()
-			case "seekTo":
-				position, err := time.ParseDuration(message.args["newTime"] + "s")
-				if err != nil {
-					logger.Warnln("could not parse newTime for seekTo:", err)
-					break
+			case getPlaylist:
+				s.mp.RequestPlaylist(playlistChan)
+			case setPlaylist:
+				logger.Println("SetPlaystate:", command.VideoIds, command.CurrentIndex, command.CurrentTime, command.ListId)
+				s.mp.SetPlaystate(command.VideoIds, command.CurrentIndex, command.CurrentTime, command.ListId)
+				go s.notifyCast(command.VideoIds, command.CurrentIndex)
+			case updatePlaylist:
+				s.mp.UpdatePlaylist(command.VideoIds, command.ListId)
+				s.send(confirmPlaylistUpdate{true})
+			case setVideo:
+				s.mp.SetVideo(command.VideoId, command.CurrentTime)
+			case getNowPlaying:
+				s.mp.RequestPlaylist(nowPlayingChan)
+			case getSubtitlesTrack:
+				s.mp.RequestSubtitles()
+			case setSubtitlesTrack:
+				s.mp.SetSubtitles(command.LanguageCode)
+			case pause:
+				s.mp.Pause()
+			case play:
+				s.mp.Play()
+			case seekTo:
+				s.mp.Seek(command.NewTime)
+			case stopVideo:
+				s.mp.Stop()
+			case next:
+				s.mp.NextVideo()
+			case previous:
+				s.mp.PreviousVideo()
+			case setAutoplayMode:
+				s.setAutoplay(command.Enabled)
+			case setPlaylistMode:
+				if repeat, _ := s.mp.GetPlaylistMode(); command.Loop != (repeat != mp.REPEAT_OFF) {
+					if command.Loop {
+						s.mp.SetRepeat(mp.REPEAT_ALL)
+					} else {
+						s.mp.SetRepeat(mp.REPEAT_OFF)
+					}
+				}
+				s.mp.SetShuffle(command.Shuffle)
+			case setPlaybackSpeed:
+				s.mp.SetRate(command.Rate)
+			case dpadCommand:
+				if err := s.sendKey(command.Key); err != nil {
+					// The remote can't show errors, but the person pressing
+					// keys is looking at the TV.
+					go s.notify(NOTIFY_ERROR, "Could not press key", err.Error())
 				}
-				yt.mp.Seek(position)
-			case "stopVideo":
-				yt.mp.Stop()
-			case "next":
-				yt.mp.NextVideo()
-			case "previous":
-				yt.mp.PreviousVideo()
 			}
 
-		case <-yt.runQuit:
+		case <-s.ctx.Done():
 			// The YouTube app has been stopped.
 
-			yt.mpMutex.Lock()
-			yt.mp.Quit()
-			yt.mp = nil
-			yt.mpMutex.Unlock()
+			s.mpMutex.Lock()
+			s.mp.Quit()
+			s.mp = nil
+			s.mpMutex.Unlock()
 
 			return
 		}
 	}
 }
 
-func (yt *YouTube) playerEvents(stateChange chan mp.StateChange, volumeChan chan int, playlistChan, nowPlayingChan chan mp.PlaylistState) {
+func (s *session) playerEvents(stateChange chan mp.StateChange, events chan mp.Event, playlistChan, nowPlayingChan chan mp.PlaylistState) {
 	for {
 		select {
 		case change, ok := <-stateChange:
 			if !ok {
 				// player has quit
-				close(yt.outgoingMessages)
+				close(s.outgoingMessages)
 				return
 			}
 
 			if change.State == mp.STATE_BUFFERING || change.State == mp.STATE_STOPPED {
-				// Only access yt.mp when it is certain it isn't being quit.
-				// yt.mp is nil when it is being stopped.
-				yt.mpMutex.Lock()
-				if yt.mp != nil {
-					yt.mp.RequestPlaylist(nowPlayingChan)
+				// Only access s.mp when it is certain it isn't being quit.
+				// s.mp is nil when it is being stopped.
+				s.mpMutex.Lock()
+				if s.mp != nil {
+					s.mp.RequestPlaylist(nowPlayingChan)
 				}
-				yt.mpMutex.Unlock()
+				s.mpMutex.Unlock()
 			}
 
-			yt.outgoingMessages <- outgoingMessage{"onStateChange", map[string]string{
-				"currentTime": strconv.FormatFloat(change.Position.Seconds(), 'f', 3, 64),
-				"state":       strconv.Itoa(int(change.State)),
-			}}
-
-		case volume := <-volumeChan:
-			yt.outgoingMessages <- outgoingMessage{"onVolumeChanged", map[string]string{
-				"volume": strconv.Itoa(volume),
-				"muted":  "false",
-			}}
+			s.send(onStateChange{change.Position, change.State, change.Duration, change.Live})
+
+		case event := <-events:
+			switch event := event.(type) {
+			case mp.PlayError:
+				go func() {
+					s.notify(NOTIFY_ERROR, "Could not play video", videoTitle(event.VideoId))
+				}()
+			case mp.SubtitlesChange:
+				s.send(onSubtitlesTrackChanged{event.VideoId, event.Subtitle.Language, event.Subtitle.Name})
+			case mp.QueueChange:
+				s.send(onHasPreviousNextChanged{event.HasPrevious, event.HasNext})
+			case mp.PlaylistModeChange:
+				s.send(onPlaylistModeChanged{event.Repeat, event.Shuffle})
+			case mp.RateChange:
+				s.send(onPlaybackSpeedChanged{event.Rate})
+			case mp.VolumeChange:
+				s.send(onVolumeChanged{event.Volume, event.Muted})
+			case mp.AutoplayModeChange:
+				s.send(onAutoplayModeChanged{event.Supported, event.Enabled})
+			case mp.AutoplayUpNext:
+				s.send(autoplayUpNext{event.VideoId})
+			}
 
 		case ps := <-playlistChan:
-			message := outgoingMessage{"nowPlayingPlaylist", map[string]string{}}
-			if len(ps.Playlist) > 0 {
-				message.args["videoIds"] = strings.Join(ps.Playlist, ",")
-				message.args["videoId"] = ps.Playlist[ps.Index]
-				message.args["currentTime"] = strconv.FormatFloat(ps.Position.Seconds(), 'f', 3, 64)
-				message.args["state"] = strconv.Itoa(int(ps.State))
-				message.args["currentIndex"] = strconv.Itoa(ps.Index)
-				//message.args["listId"] = ""
-			}
-			yt.outgoingMessages <- message
+			s.send(nowPlayingPlaylist{ps})
+
 		case ps := <-nowPlayingChan:
-			message := outgoingMessage{"nowPlaying", map[string]string{}}
-			if len(ps.Playlist) > 0 {
-				message.args["videoId"] = ps.Playlist[ps.Index]
-				message.args["currentTime"] = strconv.FormatFloat(ps.Position.Seconds(), 'f', 3, 64)
-				message.args["state"] = strconv.Itoa(int(ps.State))
-				message.args["currentIndex"] = strconv.Itoa(ps.Index)
-				message.args["listId"] = ps.ListId
-			}
-			yt.outgoingMessages <- message
+			s.send(nowPlaying{ps})
 		}
 	}
 }
 
+// send queues a command to be sent to all connected remotes.
+func (s *session) send(command outgoingCommand) {
+	s.outgoingMessages <- command.message()
+}
+
 func (yt *YouTube) Running() bool {
-	yt.runningMutex.Lock()
-	defer yt.runningMutex.Unlock()
-	return yt.running
+	yt.sessionMutex.Lock()
+	defer yt.sessionMutex.Unlock()
+	return yt.session != nil
 }
 
-func (yt *YouTube) connect() {
-	yt.loadLoungeToken()
+// Status returns the state of the lounge connection and the connected
+// remotes.
+func (yt *YouTube) Status() apps.Status {
+	yt.sessionMutex.Lock()
+	s := yt.session
+	yt.sessionMutex.Unlock()
+
+	status := apps.Status{
+		Name:       yt.FriendlyName(),
+		Running:    s != nil,
+		Connection: CONNECTION_STOPPED.String(),
+		Remotes:    []apps.Remote{},
+	}
+	if s != nil {
+		state, _, _ := s.connection.get()
+		status.Connection = state.String()
+		status.Remotes = s.remotes.list()
+		status.Player = s.playerStatus()
+	}
+	return status
+}
+
+// sendKey presses a key on the media player. Keys it doesn't support are
+// logged and reported in the error.
+func (s *session) sendKey(key mp.Key) error {
+	player := s.player()
+	if player == nil {
+		return errors.New("player is not running")
+	}
+	err := player.SendKey(key)
+	if err == mp.ErrUnsupportedKey {
+		logger.Warnln("unsupported key:", key)
+		return fmt.Errorf("unsupported key: %s", key)
+	} else if err != nil {
+		logger.Warnln("could not send key:", err)
+	}
+	return err
+}
 
-	// Start sending/receiving channel.
-	// There should now be enough information.
-	yt.bind()
+// player returns the media player, or nil when it isn't running. The player
+// may be quit at any moment, but then its methods won't do anything.
+func (s *session) player() *mp.MediaPlayer {
+	s.mpMutex.Lock()
+	defer s.mpMutex.Unlock()
+	return s.mp
 }
 
-func (yt *YouTube) loadLoungeToken() {
+// playerStatus returns the state of the media player, or nil when nothing is
+// playing.
+func (s *session) playerStatus() *apps.Player {
+	player := s.player()
+	if player == nil {
+		return nil
+	}
+
+	streams, current, err := player.GetAudioStreams()
+	if err != nil {
+		return nil
+	}
+	repeat, shuffle := player.GetPlaylistMode()
+	status := &apps.Player{
+		Rate:         player.GetRate(),
+		Repeat:       repeat.String(),
+		Shuffle:      shuffle,
+		AudioStreams: make([]apps.AudioStream, len(streams)),
+		AudioStream:  current,
+	}
+	for i, stream := range streams {
+		status.AudioStreams[i] = apps.AudioStream{Index: stream.Index, Language: stream.Language, Name: stream.Name}
+	}
+	return status
+}
+
+// Control handles commands from the API:
+//     approve id=<remote ID> code=<code>
+//                              allow a remote for the rest of this run, with
+//                              the approval code shown on the screen
+//     deny id=<remote ID> code=<code>
+//                              deny a remote for the rest of this run
+//     audio index=<index>      switch to another audio stream
+//     audio language=<code>    switch to the audio stream in a language
+//     key name=<key>           press a key, see mp.Key
+//     speed rate=<rate>        change the playback speed (1 is normal)
+//     repeat mode=<mode>       repeat "off", "one" (video) or "all" (queue)
+//     shuffle enabled=<bool>   enable or disable shuffle
+func (yt *YouTube) Control(command string, args url.Values) error {
+	yt.sessionMutex.Lock()
+	s := yt.session
+	yt.sessionMutex.Unlock()
+
+	if s == nil {
+		return errors.New("app is not running")
+	}
+
+	switch command {
+	case "approve", "deny":
+		access := ACCESS_ALLOWED
+		if command == "deny" {
+			access = ACCESS_DENIED
+		}
+		remote, err := s.remotes.setAccess(args.Get("id"), access, args.Get("code"))
+		if err == errNoSuchRemote {
+			return errors.New("no such remote: " + args.Get("id"))
+		} else if err != nil {
+			logger.Warnf("could not %s remote %s (%s): %s\n", command, remote.Name, remote.Id, err)
+			return err
+		}
+		logger.Printf("Remote %s (%s) is now %s\n", remote.Name, remote.Id, access)
+		if access == ACCESS_ALLOWED {
+			go s.notify(NOTIFY_CONNECT, NOTIFY_TITLE, remoteLabel(remote)+" connected")
+		}
+		return nil
+	case "audio":
+		player := s.player()
+		if player == nil {
+			return errors.New("player is not running")
+		}
+		index := -1
+		if args.Get("index") != "" {
+			var err error
+			index, err = strconv.Atoi(args.Get("index"))
+			if err != nil || index < 0 {
+				return errors.New("invalid audio stream index: " + args.Get("index"))
+			}
+		} else if args.Get("language") == "" {
+			return errors.New("audio needs an index or a language")
+		}
+		return player.SetAudioStream(index, args.Get("language"))
+	case "speed":
+		player := s.player()
+		if player == nil {
+			return errors.New("player is not running")
+		}
+		rate, err := strconv.ParseFloat(args.Get("rate"), 64)
+		if err != nil {
+			return errors.New("invalid playback speed: " + args.Get("rate"))
+		}
+		return player.SetRate(rate)
+	case "repeat":
+		player := s.player()
+		if player == nil {
+			return errors.New("player is not running")
+		}
+		mode, ok := mp.ParseRepeatMode(args.Get("mode"))
+		if !ok {
+			return errors.New("invalid repeat mode: " + args.Get("mode"))
+		}
+		player.SetRepeat(mode)
+		return nil
+	case "shuffle":
+		player := s.player()
+		if player == nil {
+			return errors.New("player is not running")
+		}
+		shuffle, err := strconv.ParseBool(args.Get("enabled"))
+		if err != nil {
+			return errors.New("invalid shuffle value: " + args.Get("enabled"))
+		}
+		player.SetShuffle(shuffle)
+		return nil
+	case "key":
+		if args.Get("name") == "" {
+			return errors.New("key needs a name")
+		}
+		return s.sendKey(mp.ParseKey(args.Get("name")))
+	default:
+		return apps.ErrUnknownCommand
+	}
+}
+
+// connect is the connection supervisor: it keeps the message channel open
+// until the app quits, waiting with a backoff while YouTube can't be reached.
+func (s *session) connect() {
+	// Messages are queued until a session is ready, so the sending side can
+	// start right away.
+	go s.sendMessages()
+
+	retry := backoff{max: MAX_RETRY_TIMEOUT}
+	for {
+		if state, _, _ := s.connection.get(); state != CONNECTION_OFFLINE {
+			// While offline, connection attempts are probes that don't change
+			// the state until they succeed.
+			s.connection.set(CONNECTION_CONNECTING, nil)
+		}
+
+		err := s.bind(&retry)
+		if err == nil || !s.running() {
+			// the app has quit
+			s.connection.set(CONNECTION_STOPPED, nil)
+			return
+		}
+
+		s.connection.set(CONNECTION_OFFLINE, err)
+		timeout := retry.next()
+		logger.Warnf("could not connect to the lounge, retrying in %s\n", timeout/time.Millisecond*time.Millisecond)
+
+		select {
+		case <-time.After(timeout):
+		case <-s.ctx.Done():
+			s.connection.set(CONNECTION_STOPPED, nil)
+			return
+		}
+	}
+}
+
+func (s *session) loadLoungeToken() error {
+	screenId, err := getScreenId()
+	if err != nil {
+		return err
+	}
 	params := url.Values{
-		"screen_ids": []string{yt.getScreenId()},
+		"screen_ids": []string{screenId},
 	}
 	logger.Println("Getting lounge token batch...")
-	response, err := httpPostFormBody("https://www.youtube.com/api/lounge/pairing/get_lounge_token_batch", params)
+	response, err := httpPostFormBody(loungeURL+"/pairing/get_lounge_token_batch", params)
 	if err != nil {
-		// TODO exit the app or something when this happens, don't panic
-		logger.Panic(err)
+		return fmt.Errorf("could not get lounge token: %s", err)
 	}
 	loungeTokenBatch := loungeTokenBatchJson{}
-	json.Unmarshal(response, &loungeTokenBatch)
-	yt.loungeToken = loungeTokenBatch.Screens[0].LoungeToken
+	err = json.Unmarshal(response, &loungeTokenBatch)
+	if err != nil {
+		return fmt.Errorf("could not decode lounge token: %s", err)
+	}
+	if len(loungeTokenBatch.Screens) == 0 || loungeTokenBatch.Screens[0].LoungeToken == "" {
+		return errors.New("no lounge token received")
+	}
+
+	s.sendMutex.Lock()
+	s.loungeToken = loungeTokenBatch.Screens[0].LoungeToken
+	s.sendMutex.Unlock()
+	return nil
 }
 
-func (yt *YouTube) getScreenId() string {
+func getScreenId() (string, error) {
 	screenId, err := config.Get().GetString("apps.youtube.screenId", func() (string, error) {
 		logger.Println("Getting screen_id...")
-		response, err := httpGetBody("https://www.youtube.com/api/lounge/pairing/generate_screen_id")
+		response, err := httpGetBody(loungeURL+"/pairing/generate_screen_id")
+		if err == nil && len(response) == 0 {
+			err = errors.New("empty response")
+		}
 		return string(response), err
 	})
 	if err != nil {
-		// TODO use proper error handling
-		logger.Panic(err)
+		return "", fmt.Errorf("could not get screen_id: %s", err)
 	}
 
-	return screenId
+	return screenId, nil
 }
 
-func (yt *YouTube) openChannel(initial bool) *http.Response {
-	if initial {
-		yt.rid.Restart()
+// Errors returned by openChannel for which the connection is restarted.
+var (
+	errUnknownSID = errors.New("400 Unknown SID")
+	errGone       = errors.New("410 Gone")
+)
 
-		logger.Println("Getting first batch of messages")
+// openChannel does a single request to open the message channel. With
+// initial set, it starts a new session, taking over the previous session if
+// there is one.
+func (s *session) openChannel(initial bool) (*http.Response, error) {
+	s.sendMutex.Lock()
+	aid := s.aid
+	sid := s.sid
+	gsessionid := s.gsessionid
+	loungeToken := s.loungeToken
+	s.sendMutex.Unlock()
+
+	var bindUrl string
+	// TODO more fields should be query-escaped
+	if !initial {
+		// normal reconnect
+		bindUrl = fmt.Sprintf(loungeURL+"/bc/bind?device=LOUNGE_SCREEN&id=%s&name=%s&loungeIdToken=%s&VER=8&RID=rpc&SID=%s&CI=0&AID=%d&gsessionid=%s&TYPE=xmlhttp&zx=%s",
+			s.uuid, url.QueryEscape(s.systemName), loungeToken, sid, aid, gsessionid, zx())
+	} else if sid == "" {
+		// first connection
+		bindUrl = fmt.Sprintf(loungeURL+"/bc/bind?device=LOUNGE_SCREEN&id=%s&name=%s&loungeIdToken=%s&VER=8&RID=%d&zx=%s",
+			s.uuid, url.QueryEscape(s.systemName), loungeToken, s.rid.Next(), zx())
+	} else {
+		// connection after a 400 Unknown SID error, or a resumed session
+		bindUrl = fmt.Sprintf(loungeURL+"/bc/bind?device=LOUNGE_SCREEN&id=%s&name=%s&loungeIdToken=%s&OSID=%s&OAID=%d&VER=8&RID=%d&zx=%s",
+			s.uuid, url.QueryEscape(s.systemName), loungeToken, sid, aid, s.rid.Next(), zx())
 	}
 
-	doInitial := initial
-
-	// How often the connection was retried. Zero on normal operation.
-	// The retry timeout increases exponentially with the number of failures.
-	retries := 0
-
-	for {
-		yt.sendMutex.Lock()
-		aid := yt.aid
-		yt.sendMutex.Unlock()
-
-		var bindUrl string
-		// TODO more fields should be query-escaped
-		if !doInitial {
-			// normal reconnect
-			bindUrl = fmt.Sprintf("https://www.youtube.com/api/lounge/bc/bind?device=LOUNGE_SCREEN&id=%s&name=%s&loungeIdToken=%s&VER=8&RID=rpc&SID=%s&CI=0&AID=%d&gsessionid=%s&TYPE=xmlhttp&zx=%s",
-				yt.uuid, url.QueryEscape(yt.systemName), yt.loungeToken, yt.sid, aid, yt.gsessionid, zx())
-		} else if yt.sid == "" {
-			// first connection
-			bindUrl = fmt.Sprintf("https://www.youtube.com/api/lounge/bc/bind?device=LOUNGE_SCREEN&id=%s&name=%s&loungeIdToken=%s&VER=8&RID=%d&zx=%s",
-				yt.uuid, url.QueryEscape(yt.systemName), yt.loungeToken, yt.rid.Next(), zx())
-		} else {
-			// connection after a 400 Unknown SID error
-			bindUrl = fmt.Sprintf("https://www.youtube.com/api/lounge/bc/bind?device=LOUNGE_SCREEN&id=%s&name=%s&loungeIdToken=%s&OSID=%s&OAID=%d&VER=8&RID=%d&zx=%s",
-				yt.uuid, url.QueryEscape(yt.systemName), yt.loungeToken, yt.sid, aid, yt.rid.Next(), zx())
-		}
-
-		timeBeforeGet := time.Now()
+	timeBeforeGet := time.Now()
 
-		var resp *http.Response
-		var err error
-		if doInitial {
-			params := url.Values{
-				"count": []string{"0"},
-			}
-			resp, err = http.PostForm(bindUrl, params)
-		} else {
-			resp, err = http.Get(bindUrl)
+	// The request is cancelled when the app quits.
+	var req *http.Request
+	var err error
+	if initial {
+		params := url.Values{
+			"count": []string{"0"},
 		}
-
-		if err != nil {
-			if err == io.EOF {
-				if !yt.errorRetryTimeout(&retries, "EOF on bind", err) {
-					yt.Quit()
-					break
-				}
-				// reconnect
-				continue
-			} else if _, ok := err.(net.Error); ok && err.(net.Error).Timeout() {
-				logger.Warnln("timeout while connecting to message channel, retrying in 30s...")
-				time.Sleep(30 * time.Second)
-				continue
-			}
-			logger.Errln(err)
-			yt.Quit()
-			break
+		req, err = http.NewRequestWithContext(s.ctx, "POST", bindUrl, strings.NewReader(params.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		}
+	} else {
+		req, err = http.NewRequestWithContext(s.ctx, "GET", bindUrl, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp, err := streamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
 
-		if resp.Status == "400 Unknown SID" {
-			logger.Println("error:", resp.Status, ". Reconnecting the message channel...")
-			// Restart the Channel API connection
-			doInitial = true
-			continue
+	if resp.Status == "400 Unknown SID" {
+		resp.Body.Close()
+		return nil, errUnknownSID
 
-		} else if resp.Status == "410 Gone" {
-			if !yt.errorRetryTimeout(&retries, "got 410 Gone on reconnect", nil) {
-				yt.Quit()
-				break
-			}
+	} else if resp.Status == "410 Gone" {
+		resp.Body.Close()
+		return nil, errGone
 
-			// Restart Channel API connection from the beginning
-			yt.sendMutex.Lock()
-			yt.sid = ""
-			yt.loadLoungeToken()
-			yt.sendMutex.Unlock()
-			doInitial = true
-			continue
+	} else if resp.StatusCode != 200 {
+		logger.Errln("HTTP error while connecting to message channel:", resp.Status)
 
-		} else if resp.StatusCode == 502 {
-			if !yt.errorRetryTimeout(&retries, "got HTTP error 502 on reconnect", nil) {
-				yt.Quit()
-				break
-			}
-			continue
+		// most likely the YouTube server gives back an error in HTML form
+		printHTTPError(resp)
+		resp.Body.Close()
 
-		} else if resp.StatusCode != 200 {
-			logger.Errln("HTTP error while connecting to message channel:", resp.Status)
+		return nil, errors.New("HTTP error while connecting to message channel: " + resp.Status)
+	}
 
-			// most likely the YouTube server gives back an error in HTML form
-			printHTTPError(resp)
+	if !initial {
+		latency := time.Now().Sub(timeBeforeGet) / time.Millisecond * time.Millisecond
+		logger.Println("Connected to message channel in", latency)
+	}
 
-			yt.Quit()
-			break
-		}
+	if initial {
+		s.sendMutex.Lock()
+		s.aid = -1
+		s.sendMutex.Unlock()
+	}
 
-		if !initial {
-			latency := time.Now().Sub(timeBeforeGet) / time.Millisecond * time.Millisecond
-			logger.Println("Connected to message channel in", latency)
-		}
+	return resp, nil
+}
 
-		if doInitial {
-			yt.sendMutex.Lock()
-			yt.aid = -1
-			yt.sendMutex.Unlock()
+// bind keeps the message channel open. It returns nil when the app has quit,
+// or an error when the lounge can't be reached.
+func (s *session) bind(retry *backoff) error {
+	s.sendMutex.Lock()
+	haveToken := s.loungeToken != ""
+	initial := !s.sessionReady
+	s.sendMutex.Unlock()
+
+	if !haveToken {
+		// A resumed session already has a lounge token.
+		if err := s.loadLoungeToken(); err != nil {
+			return err
 		}
-
-		return resp
 	}
 
-	return nil
-}
+	// Whether the current session was rejected while trying to take it over.
+	takeoverFailed := false
 
-func (yt *YouTube) bind() {
+	for {
+		if !s.running() {
+			return nil
+		}
 
-	resp := yt.openChannel(true)
-	if resp == nil || yt.handleMessageStream(resp, true) {
-		return
-	}
+		if initial {
+			s.setSessionReady(false)
+			s.sendMutex.Lock()
+			sid := s.sid
+			s.sendMutex.Unlock()
+			if sid == "" {
+				s.rid.Restart()
+				logger.Println("Getting first batch of messages")
+			} else {
+				logger.Println("Taking over session", sid)
+			}
+		}
 
-	// now yt.sid and yt.gsessionid should be defined, so sendMessages has
-	// enough information to start
+		resp, err := s.openChannel(initial)
+		switch err {
+		case nil:
+		case errUnknownSID:
+			logger.Println("error:", err, ". Reconnecting the message channel...")
+			if initial {
+				if takeoverFailed {
+					return err
+				}
+				// The old session could not be taken over (for example, a
+				// resumed session that has expired): start a new session.
+				takeoverFailed = true
+				s.sendMutex.Lock()
+				s.sid = ""
+				s.sendMutex.Unlock()
+			}
+			// Restart the Channel API connection
+			initial = true
+			continue
+		case errGone:
+			// Restart Channel API connection from the beginning
+			s.sendMutex.Lock()
+			s.sid = ""
+			s.loungeToken = ""
+			s.sendMutex.Unlock()
+			s.setSessionReady(false)
+			return err
+		default:
+			return err
+		}
 
-	go yt.sendMessages()
+		s.connection.set(CONNECTION_ONLINE, nil)
+		retry.reset()
 
-	// Loop to keep the connection open
-	for {
-		resp := yt.openChannel(false)
-		if resp == nil {
-			break
-		}
-		if yt.handleMessageStream(resp, false) {
-			break
+		if s.handleMessageStream(resp, initial) {
+			return nil
 		}
-	}
-}
 
-// errorRetryTimeout waits an exponential amount of time to retry something, or
-// gives up after a number of retries. It returns true when it should retry, or
-// false otherwise.
-func (yt *YouTube) errorRetryTimeout(retries *int, message string, err error) bool {
-	*retries++
-	retryTimeout := time.Duration((*retries)*(*retries)) * RETRY_TIMEOUT * time.Millisecond
-	ending := ""
-	if err != nil {
-		ending = ": " + err.Error()
-	}
-	if *retries > RETRIES {
-		logger.Errf("%s, giving up%s\n", message, ending)
-		return false
+		// The first batch of a new session should contain the SID and
+		// gsessionid. If it didn't, start over.
+		s.sendMutex.Lock()
+		initial = !s.sessionReady
+		s.sendMutex.Unlock()
+		if !initial {
+			takeoverFailed = false
+		}
 	}
-	logger.Warnf("%s, retrying in %s%s\n", message, retryTimeout, ending)
-	time.Sleep(retryTimeout)
-	return true
 }
 
-func (yt *YouTube) handleMessageStream(resp *http.Response, singleBatch bool) bool {
-	defer resp.Body.Close()
+func (s *session) handleMessageStream(resp *http.Response, singleBatch bool) bool {
+	body := newIdleTimeoutReader(resp.Body, READ_TIMEOUT)
+	defer body.Close()
 
-	reader := bufio.NewReader(resp.Body)
+	reader := bufio.NewReader(body)
 
 	for {
-		line, err := reader.ReadString('\n')
+		data, err := readChunk(reader)
 		if err != nil {
-			if line == "" && err == io.EOF {
+			if err == io.EOF {
 				// The stream has terminated.
 				return false // try again
 			}
+			if err == errReadTimeout {
+				// The long-poll request hangs.
+				logger.Warnln(err)
+				s.connection.set(CONNECTION_CONNECTING, nil)
+				return false
+			}
 
-			logger.Printf("error: %s (line: %#v)\n", err, line)
+			logger.Println("error:", err)
 
 			// try again
 			logger.Println("Trying to reconnect to message channel...")
 			return false
 		}
 
-		length, err := strconv.Atoi(line[:len(line)-1])
+		messages, err := decodeChunk(data)
 		if err != nil {
-			panic(err)
-		}
-
-		data := make([]byte, length)
-		_, err = io.ReadFull(reader, data)
-		if err != nil {
-			panic(err)
+			// The framing is still intact, so the next chunk can be read.
+			logger.Warnln(err)
+			continue
 		}
-
-		messages := incomingMessagesJson{}
-		json.Unmarshal(data, &messages)
-		for _, message := range messages {
-			if yt.handleRawReceivedMessage(message) {
+		for _, data := range messages {
+			message, err := decodeMessage(data)
+			if err != nil {
+				logger.Warnln("dropping message:", err)
+				continue
+			}
+			if s.handleRawReceivedMessage(message) {
 				return true
 			}
 		}
@@ -640,32 +924,30 @@ func (yt *YouTube) handleMessageStream(resp *http.Response, singleBatch bool) bo
 	return false
 }
 
-func (yt *YouTube) handleRawReceivedMessage(rawMessage incomingMessageJson) bool {
+func (s *session) handleRawReceivedMessage(rawMessage rawMessage) bool {
 	message := incomingMessage{}
-	message.index = int(rawMessage[0].(float64))
+	message.index = rawMessage.index
+	message.command = rawMessage.command
 
-	if message.index != int(yt.aid+1) {
-		if message.index <= int(yt.aid) {
-			logger.Warnln("old command:", message.index, message.command, message.args)
+	s.sendMutex.Lock()
+	aid := s.aid
+	if message.index > int(aid) {
+		s.aid = int32(message.index)
+	}
+	s.sendMutex.Unlock()
+
+	if message.index != int(aid+1) {
+		if message.index <= int(aid) {
+			logger.Warnln("old command:", message.index, message.command)
 			return false
 		} else {
-			logger.Errf("missing some messages, message number=%d, expected number=%d\n", message.index, yt.aid)
+			logger.Errf("missing some messages, message number=%d, expected number=%d\n", message.index, aid+1)
 		}
 	}
-	yt.aid = int32(message.index)
 
-	message.command = rawMessage[1].([]interface{})[0].(string)
+	args := rawMessage.args
 
-	args := make([]interface{}, len(rawMessage[1].([]interface{}))-1)
-
-	for i := 0; i < len(args); i++ {
-		args[i] = rawMessage[1].([]interface{})[i+1]
-	}
-
-	yt.runningMutex.Lock()
-	running := yt.running
-	yt.runningMutex.Unlock()
-	if !running {
+	if !s.running() {
 		return true
 	}
 
@@ -681,7 +963,9 @@ func (yt *YouTube) handleRawReceivedMessage(rawMessage incomingMessageJson) bool
 		if !ok {
 			logger.Warnln("SID is not a string")
 		} else {
-			yt.sid = sid
+			s.sendMutex.Lock()
+			s.sid = sid
+			s.sendMutex.Unlock()
 		}
 	case "S":
 		if len(args) == 0 {
@@ -692,123 +976,206 @@ func (yt *YouTube) handleRawReceivedMessage(rawMessage incomingMessageJson) bool
 		if !ok {
 			logger.Warnln("gsessionid is not a string")
 		} else {
-			yt.gsessionid = gsessionid
+			// The gsessionid is the last part of the session to arrive.
+			s.sendMutex.Lock()
+			s.gsessionid = gsessionid
+			s.sendMutex.Unlock()
+			s.setSessionReady(true)
 		}
 	default:
-		if len(args) > 0 {
-			// convert map[string]interface{} into map[string]string
-			argsMap, ok := args[0].(map[string]interface{})
-			if !ok {
-				logger.Warnln("message values are not a map", message.command)
-			}
-			message.args = make(map[string]string, len(argsMap))
-			for k, v := range argsMap {
-				if s, ok := v.(string); !ok {
-					logger.Warnln("message", message.command, "does not have string value for key", k)
-				} else {
-					message.args[k] = s
-				}
-			}
+		var err error
+		message.args, err = decodeArgs(rawMessage)
+		if err != nil {
+			logger.Warnln("dropping message:", err)
+			break
+		}
+		select {
+		case s.incomingMessages <- message:
+		case <-s.ctx.Done():
+			return true
 		}
-		yt.incomingMessages <- message
 	}
 
 	return false
 }
 
-func (yt *YouTube) sendMessages() {
-	queuedMessages := make([]outgoingMessage, 0, 3)
-	count := 0
+// setSessionReady marks whether messages can be sent in the current session.
+// sendMessages is notified when a new session becomes ready.
+func (s *session) setSessionReady(ready bool) {
+	s.sendMutex.Lock()
+	s.sessionReady = ready
+	s.sendMutex.Unlock()
 
-	var deadline time.Time
-	deadlineStart := make(chan struct{})
-	deadlineEnd := make(chan struct{})
-	go func() {
-		for _ = range deadlineStart {
-			// It looks like 10ms is a good default. HTTP latency appears to be
-			// relatively independent of the machine performance, so I guess it is bound
-			// by the speed of light...
-			time.Sleep(10 * time.Millisecond)
-			deadlineEnd <- struct{}{}
+	if ready {
+		select {
+		case s.sessionChange <- struct{}{}:
+		default:
+			// already signalled
+		}
+	}
+}
+
+var errSessionNotReady = errors.New("session not ready")
+
+// sendBatch sends all unacknowledged messages in the queue. It returns
+// errSessionNotReady when there is no session to send them in yet.
+func (s *session) sendBatch(queue *outgoingQueue) error {
+	s.sendMutex.Lock()
+	ready := s.sessionReady
+	sid := s.sid
+	gsessionid := s.gsessionid
+	aid := s.aid
+	loungeToken := s.loungeToken
+	s.sendMutex.Unlock()
+
+	if !ready {
+		return errSessionNotReady
+	}
+
+	ofs, messages := queue.batch(sid)
+	if len(messages) == 0 {
+		return nil
+	}
+
+	values := url.Values{
+		"count": []string{strconv.Itoa(len(messages))}, // the amount of messages in this POST
+		"ofs":   []string{strconv.Itoa(ofs)},           // which index the first message has
+	}
+	for i, message := range messages {
+		req := "req" + strconv.Itoa(i) + "_"
+		values.Set(req+"_sc", message.command)
+		for k, v := range message.args {
+			values.Set(req+k, v)
 		}
-	}()
-	defer close(deadlineStart)
+		logger.Println("send msg:", message.command, message.args)
+	}
+
+	timeBeforeSend := time.Now()
+
+	_, err := httpPostFormBody(fmt.Sprintf(loungeURL+"/bc/bind?device=LOUNGE_SCREEN&id=%s&name=%s&loungeIdToken=%s&VER=8&SID=%s&RID=%d&AID=%d&gsessionid=%s&zx=%s",
+		s.uuid, url.QueryEscape(s.systemName), loungeToken, sid, s.rid.Next(), aid, gsessionid, zx()), values)
+	if err != nil {
+		return err
+	}
+
+	queue.ack(sid, len(messages))
+
+	httpLatency := time.Now().Sub(timeBeforeSend) / time.Millisecond * time.Millisecond
+	logger.Printf("messages sent: %d (ofs %d, http latency %s)\n", len(messages), ofs, httpLatency)
+
+	return nil
+}
+
+// A pairing code that couldn't be registered yet.
+type pendingPairingCode struct {
+	code     string
+	received time.Time
+}
+
+// How long a pairing code can be used after the app was launched with it.
+const PAIRING_CODE_TIMEOUT = 5 * time.Minute
+
+func (s *session) sendMessages() {
+	queue := &outgoingQueue{}
+	retry := backoff{max: MAX_SEND_RETRY_TIMEOUT}
+	var pendingPairingCodes []pendingPairingCode
+
+	// The flush timer is only running while flushPending is true, so it never
+	// has to be drained before a Reset.
+	flush := time.NewTimer(time.Hour)
+	flush.Stop()
+	flushPending := false
+	scheduleFlush := func(timeout time.Duration) {
+		if !flushPending {
+			flushPending = true
+			flush.Reset(timeout)
+		}
+	}
+	defer flush.Stop()
 
 	for {
 		select {
-		case message, ok := <-yt.outgoingMessages:
+		case message, ok := <-s.outgoingMessages:
 			if !ok {
 				// This is the sign the sendMessages goroutine should quit.
-				yt.Quit()
+				s.quit()
 				logger.Println("quited")
 				return
 			}
 
-			queuedMessages = append(queuedMessages, message)
+			queue.push(message)
 
-			if deadline.IsZero() {
-				deadline = time.Now()
-				deadlineStart <- struct{}{}
-				continue
-			}
+			// It looks like 10ms is a good default. HTTP latency appears to be
+			// relatively independent of the machine performance, so I guess it is bound
+			// by the speed of light...
+			scheduleFlush(10 * time.Millisecond)
+
+		case <-flush.C:
+			flushPending = false
 
-		case <-deadlineEnd:
-			values := url.Values{
-				"count": []string{strconv.Itoa(len(queuedMessages))}, // the amount of messages in this POST
-				"ofs":   []string{strconv.Itoa(count)},               // which index the first message has
+			err := s.sendBatch(queue)
+			if err == errSessionNotReady {
+				// Wait for sessionChange.
+				logger.Println("waiting for a session to send messages")
+				break
 			}
-			for i, message := range queuedMessages {
-				req := "req" + strconv.Itoa(i) + "_"
-				values.Set(req+"_sc", message.command)
-				for k, v := range message.args {
-					values.Set(req+k, v)
-				}
-				logger.Println("send msg:", message.command, message.args)
+			if err != nil {
+				timeout := retry.next()
+				logger.Warnf("could not send message, retrying in %s: %s\n", timeout/time.Millisecond*time.Millisecond, err)
+				scheduleFlush(timeout)
+				break
 			}
+			retry.reset()
 
-			timeBeforeSend := time.Now()
-
-			retries := 0
-			for {
-				yt.sendMutex.Lock()
-				_, err := httpPostFormBody(fmt.Sprintf("https://www.youtube.com/api/lounge/bc/bind?device=LOUNGE_SCREEN&id=%s&name=%s&loungeIdToken=%s&VER=8&SID=%s&RID=%d&AID=%d&gsessionid=%s&zx=%s",
-					yt.uuid, url.QueryEscape(yt.systemName), yt.loungeToken, yt.sid, yt.rid.Next(), yt.aid, yt.gsessionid, zx()), values)
-				yt.sendMutex.Unlock()
+		case <-s.sessionChange:
+			if !queue.empty() {
+				retry.reset()
+				if flushPending && !flush.Stop() {
+					<-flush.C
+				}
+				flushPending = false
+				scheduleFlush(0)
+			}
 
-				if err != nil {
-					if !yt.errorRetryTimeout(&retries, "could not send message", err) {
-						yt.Quit()
-						return
-					}
+			// The lounge is reachable again, so try the pairing codes that
+			// couldn't be registered before.
+			codes := pendingPairingCodes
+			pendingPairingCodes = nil
+			for _, code := range codes {
+				if time.Since(code.received) > PAIRING_CODE_TIMEOUT {
+					logger.Warnln("dropping expired pairing code")
 					continue
 				}
-
-				retries = 0
-				break
+				if err := s.registerPairingCode(code.code); err != nil {
+					logger.Warnln("could not register pairing code:", err)
+					pendingPairingCodes = append(pendingPairingCodes, code)
+				}
 			}
 
-			prepareLatency := timeBeforeSend.Sub(deadline) / time.Millisecond * time.Millisecond
-			httpLatency := time.Now().Sub(timeBeforeSend) / time.Millisecond * time.Millisecond
-			logger.Printf("messages sent: %d (prepare %s, http latency %s)\n", len(queuedMessages), prepareLatency, httpLatency)
-
-			count += len(queuedMessages)
-			queuedMessages = queuedMessages[:0]
-
-			deadline = time.Time{}
-
-		case pairingCode := <-yt.pairingCodes:
+		case pairingCode := <-s.pairingCodes:
 			// Register the pairing code: that can be done after sending and
 			// receiving message channels have been set up.
-			logger.Println("Registering pairing code...")
-			params := url.Values{
-				"access_type":  []string{"permanent"},
-				"pairing_code": []string{pairingCode},
-				"screen_id":    []string{yt.getScreenId()},
-			}
-			_, err := httpPostFormBody("https://www.youtube.com/api/lounge/pairing/register_pairing_code", params)
-			if err != nil {
-				logger.Warnln("could not register pairing code:", err)
+			if err := s.registerPairingCode(pairingCode); err != nil {
+				logger.Warnln("could not register pairing code, retrying when online:", err)
+				pendingPairingCodes = append(pendingPairingCodes, pendingPairingCode{pairingCode, time.Now()})
 			}
 		}
 	}
 }
+
+// registerPairingCode registers the pairing code of a device that launched
+// the app via DIAL, so it will connect to this screen.
+func (s *session) registerPairingCode(pairingCode string) error {
+	logger.Println("Registering pairing code...")
+	screenId, err := getScreenId()
+	if err != nil {
+		return err
+	}
+	params := url.Values{
+		"access_type":  []string{"permanent"},
+		"pairing_code": []string{pairingCode},
+		"screen_id":    []string{screenId},
+	}
+	_, err = httpPostFormBody(loungeURL+"/pairing/register_pairing_code", params)
+	return err
+}
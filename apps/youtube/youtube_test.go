@@ -0,0 +1,231 @@
+package youtube
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The tests run the app against a fake lounge and a fake Kodi (JSON-RPC over
+// HTTP), so they exercise the whole run of a session. Run them with -race.
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	lounge := httptest.NewServer(newFakeLounge())
+	loungeURL = lounge.URL
+
+	kodi := httptest.NewServer(http.HandlerFunc(serveFakeKodi))
+	host, port, err := net.SplitHostPort(kodi.Listener.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	flag.Set("no-config", "true")
+	flag.Set("kodi-transport", "http")
+	flag.Set("kodi-host", host)
+	flag.Set("kodi-http-port", port)
+
+	code := m.Run()
+	lounge.Close()
+	kodi.Close()
+	os.Exit(code)
+}
+
+// fakeLounge is a lounge server that starts a new session for every screen
+// that binds, and sends a few commands in every long-poll request.
+type fakeLounge struct {
+	mutex    sync.Mutex
+	sessions int
+	indices  map[string]int // next message index per SID
+}
+
+func newFakeLounge() *fakeLounge {
+	return &fakeLounge{indices: make(map[string]int)}
+}
+
+func (l *fakeLounge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/pairing/generate_screen_id":
+		fmt.Fprint(w, "fake-screen")
+	case "/pairing/get_lounge_token_batch":
+		fmt.Fprint(w, `{"screens":[{"screenId":"fake-screen","expiration":0,"loungeToken":"fake-token"}]}`)
+	case "/pairing/register_pairing_code":
+	case "/bc/bind":
+		sid := r.URL.Query().Get("SID")
+		switch {
+		case sid == "":
+			l.mutex.Lock()
+			l.sessions++
+			sid = "SID" + strconv.Itoa(l.sessions)
+			l.indices[sid] = 2
+			l.mutex.Unlock()
+			writeChunk(w, fmt.Sprintf(`[[0,["c",%q,"",8]],[1,["S","gsession"]]]`, sid))
+		case r.Method == "POST":
+			// Outgoing messages.
+		default:
+			l.mutex.Lock()
+			index := l.indices[sid]
+			l.indices[sid] = index + 5
+			l.mutex.Unlock()
+			writeChunk(w, fmt.Sprintf(`[[%d,["remoteConnected",{"id":"remote","name":"Phone","user":"Alice","app":"android"}]],[%d,["getVolume"]],[%d,["setVolume",{"volume":"30"}]],[%d,["getNowPlaying"]],[%d,["dpadCommand",{"key":"KEYCODE_CHANNEL_UP"}]]]`, index, index+1, index+2, index+3, index+4))
+			w.(http.Flusher).Flush()
+			// Hold the long-poll request for a while, like the lounge.
+			select {
+			case <-r.Context().Done():
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeChunk(w http.ResponseWriter, data string) {
+	data += "\n"
+	fmt.Fprintf(w, "%d\n%s", len(data), data)
+}
+
+// Notifications shown by the fake Kodi, by title.
+var (
+	kodiNotifications      = make(map[string]int)
+	kodiNotificationsMutex sync.Mutex
+)
+
+// serveFakeKodi answers JSON-RPC requests like an idle Kodi.
+func serveFakeKodi(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Method string           `json:"method"`
+		Params json.RawMessage  `json:"params"`
+		Id     *json.RawMessage `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Method == "GUI.ShowNotification" {
+		var params struct {
+			Title string `json:"title"`
+		}
+		json.Unmarshal(request.Params, &params)
+		kodiNotificationsMutex.Lock()
+		kodiNotifications[params.Title]++
+		kodiNotificationsMutex.Unlock()
+	}
+	var result interface{} = "OK"
+	switch request.Method {
+	case "Player.GetActivePlayers":
+		result = []interface{}{}
+	case "Application.GetProperties":
+		result = map[string]interface{}{"volume": 50, "muted": false}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      request.Id,
+		"result":  result,
+	})
+}
+
+// waitConnection waits until the current run is connected to the lounge.
+func waitConnection(t *testing.T, yt *YouTube) {
+	deadline := time.Now().Add(10 * time.Second)
+	for yt.Status().Connection != CONNECTION_ONLINE.String() {
+		if time.Now().After(deadline) {
+			t.Fatalf("not connected to the lounge, state: %s", yt.Status().Connection)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitQuit waits until the last run of the app has completely stopped.
+func waitQuit(t *testing.T, yt *YouTube) {
+	yt.sessionMutex.Lock()
+	s := yt.lastSession
+	yt.sessionMutex.Unlock()
+	if s == nil {
+		return
+	}
+	select {
+	case <-s.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the app didn't quit")
+	}
+}
+
+func TestStartQuitStart(t *testing.T) {
+	yt := New("test")
+
+	yt.Start("")
+	waitConnection(t, yt)
+	yt.Quit()
+	if yt.Running() {
+		t.Error("running after Quit")
+	}
+
+	// Start again while the previous run may still be shutting down.
+	yt.Start("")
+	waitConnection(t, yt)
+	yt.Quit()
+	waitQuit(t, yt)
+
+	if status := yt.Status(); status.Running || status.Connection != CONNECTION_STOPPED.String() {
+		t.Errorf("got status %+v after quitting", status)
+	}
+}
+
+func TestConcurrentStartQuit(t *testing.T) {
+	yt := New("test")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if (i+j)%2 == 0 {
+					yt.Start("")
+				} else {
+					yt.Quit()
+				}
+				yt.Status()
+				time.Sleep(time.Duration(i) * time.Millisecond)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// The app must still work.
+	yt.Start("")
+	waitConnection(t, yt)
+	yt.Quit()
+	waitQuit(t, yt)
+}
+
+func TestUnsupportedKey(t *testing.T) {
+	yt := New("test")
+	yt.Start("")
+	defer waitQuit(t, yt)
+	defer yt.Quit()
+
+	// The fake lounge sends a key Kodi doesn't have.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		kodiNotificationsMutex.Lock()
+		shown := kodiNotifications["Could not press key"]
+		kodiNotificationsMutex.Unlock()
+		if shown > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("unsupported key isn't reported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -19,6 +19,7 @@ type Config struct {
 	data          map[string]interface{}
 	saveChanMutex sync.Mutex
 	saveChan      chan struct{}
+	writeMutex    sync.Mutex // serializes writes to the config file
 }
 
 var config *Config
@@ -139,6 +140,29 @@ func (c *Config) GetInt(key string, valueCall func() (int, error)) (int, error)
 	return value, err
 }
 
+func (c *Config) GetBool(key string, valueCall func() (bool, error)) (bool, error) {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	if value, ok := c.data[key]; ok {
+		if bvalue, ok := value.(bool); ok {
+			return bvalue, nil
+		} else {
+			return false, errors.New("config value for key " + key + " is not a boolean")
+		}
+	}
+
+	value, err := valueCall()
+	if err != nil {
+		return false, err
+	}
+
+	c.data[key] = value
+	c.save()
+
+	return value, nil
+}
+
 func (c *Config) SetInt(key string, value int) {
 	c.dataMutex.Lock()
 	defer c.dataMutex.Unlock()
@@ -147,6 +171,68 @@ func (c *Config) SetInt(key string, value int) {
 	c.save()
 }
 
+// GetValue decodes the (JSON) value for the key into value. It returns false
+// when there is no value for this key.
+func (c *Config) GetValue(key string, value interface{}) (bool, error) {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	data, ok := c.data[key]
+	if !ok {
+		return false, nil
+	}
+
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(buf, value); err != nil {
+		return false, errors.New("config value for key " + key + " could not be decoded: " + err.Error())
+	}
+	return true, nil
+}
+
+// SetValue stores any value that can be encoded as JSON.
+func (c *Config) SetValue(key string, value interface{}) error {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	var data interface{}
+	if err := json.Unmarshal(buf, &data); err != nil {
+		return err
+	}
+
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	c.data[key] = data
+	c.save()
+	return nil
+}
+
+// Delete removes the value for the key, if there is one.
+func (c *Config) Delete(key string) {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	if _, ok := c.data[key]; !ok {
+		return
+	}
+	delete(c.data, key)
+	c.save()
+}
+
+// Flush writes the configuration to disk synchronously. It should be called
+// before the program exits, as saving normally happens in the background.
+func (c *Config) Flush() {
+	if *disableConfig || c.path == "" {
+		return
+	}
+
+	c.write()
+}
+
 func (c *Config) save() {
 	if *disableConfig {
 		return
@@ -176,17 +262,27 @@ func (c *Config) save() {
 // asynchronously.
 func (c *Config) saveTask() {
 	for _ = range c.saveChan {
-		data, err := json.MarshalIndent(&c.data, "", "\t")
-		handle(err, "could not serialize config data")
+		c.write()
+	}
+}
 
-		f, err := os.OpenFile(c.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-		handle(err, "could not open config file")
-		_, err = f.Write(data)
-		handle(err, "could not write config file")
-		handle(f.Close(), "could not close config file")
+// write serializes the configuration and atomically replaces the config file.
+func (c *Config) write() {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
 
-		handle(os.Rename(c.path+".tmp", c.path), "could not replace config file")
-	}
+	c.dataMutex.Lock()
+	data, err := json.MarshalIndent(&c.data, "", "\t")
+	c.dataMutex.Unlock()
+	handle(err, "could not serialize config data")
+
+	f, err := os.OpenFile(c.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	handle(err, "could not open config file")
+	_, err = f.Write(data)
+	handle(err, "could not write config file")
+	handle(f.Close(), "could not close config file")
+
+	handle(os.Rename(c.path+".tmp", c.path), "could not replace config file")
 }
 
 func handle(err error, message string) {
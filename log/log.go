@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
@@ -29,13 +30,14 @@ var isTerminal = terminal.IsTerminal(int(os.Stdout.Fd()))
 var flagLoglevel = flag.String("loglevel", "warn", "baseline loglevel (info, warn, err)")
 
 var loglevel = 0
+var loglevelOnce sync.Once // loggers are used from many goroutines
 
 func getLoglevel() int {
 	if !flag.Parsed() {
 		panic("log called before flag.Parse()")
 	}
 
-	if loglevel == 0 {
+	loglevelOnce.Do(func() {
 		switch *flagLoglevel {
 		case "info", "i":
 			loglevel = LOGLEVEL_INFO
@@ -47,7 +49,7 @@ func getLoglevel() int {
 			fmt.Println("Error in parsing 'loglevel' flag: unknown value")
 			os.Exit(1)
 		}
-	}
+	})
 
 	return loglevel
 }
@@ -2,12 +2,20 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
 
+	"github.com/sargo/kodicast/apps/youtube/mp"
 	"github.com/sargo/kodicast/server"
 )
 
 func main() {
 	flag.Parse()
 
+	if err := mp.CheckKodi(); err != nil {
+		fmt.Printf("ERROR: invalid Kodi settings: %s\n", err)
+		os.Exit(1)
+	}
+
 	server.Serve()
 }
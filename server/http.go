@@ -1,20 +1,25 @@
 package server
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
 	"flag"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"text/template"
 	"time"
 
 	"github.com/sargo/kodicast/apps"
 	"github.com/sargo/kodicast/apps/youtube"
+	"github.com/sargo/kodicast/config"
 )
 
 // This implements a UPnP/DIAL server.
@@ -22,6 +27,7 @@ import (
 
 var flagHTTPPort = flag.Int("http-port", 8008, "default http port (0=available)")
 var flagInitialApp = flag.String("app", "", "App to run on startup")
+var flagAPIPassword = flag.String("api-password", "", "password for the control API, which only approves remotes without it (default from config key api.password)")
 
 // UPnP device description template
 const DEVICE_DESCRIPTION = `<?xml version="1.0"?>
@@ -73,8 +79,20 @@ const HOME_TEMPLATE = `<!DOCTYPE html>
 <h1>{{.Title}}</h1>
 Apps:
 <ul>
-{{range .Apps}}
-	<li>{{.Name}} {{if .Running}}(running){{end}}</li>
+{{range $app := .Apps}}
+	<li>{{.Name}} {{if .Running}}(running{{if .Connection}}, {{.Connection}}{{end}}){{end}}
+	{{if .Remotes}}
+		<ul>
+		{{range .Remotes}}
+			<li>{{html .Name}}{{if .User}} ({{html .User}}){{end}}{{if .DeviceType}}, {{html .DeviceType}}{{end}}, connected {{.ConnectedAt.Format "15:04"}}{{if .Access}}, {{.Access}}{{end}}
+			{{if eq .Access "pending"}}
+				<form method="post" action="/api/apps/{{$app.Name}}/approve"><input type="hidden" name="id" value="{{html .Id}}"/>Code shown on the TV: <input type="text" name="code" size="6" autocomplete="off"/><button type="submit">Approve</button><button type="submit" formaction="/api/apps/{{$app.Name}}/deny">Deny</button></form>
+			{{end}}
+			</li>
+		{{end}}
+		</ul>
+	{{end}}
+	</li>
 {{end}}
 </ul>
 </body>
@@ -89,6 +107,7 @@ type UPnPServer struct {
 	apps                map[string]apps.App
 	friendlyName        string
 	appMatchString      *regexp.Regexp
+	controlMatchString  *regexp.Regexp
 	proxyClient         *http.Client
 }
 
@@ -96,6 +115,7 @@ func NewUPnPServer() *UPnPServer {
 	us := &UPnPServer{}
 
 	us.appMatchString = regexp.MustCompile("^/apps/([a-zA-Z]+)(/run)?$")
+	us.controlMatchString = regexp.MustCompile("^/api/apps/([a-zA-Z]+)/([a-zA-Z]+)$")
 	hostname, err := os.Hostname()
 	if err != nil {
 		panic(err)
@@ -111,6 +131,13 @@ func NewUPnPServer() *UPnPServer {
 		} else {
 			logger.Fatalln("Unknown app:", *flagInitialApp)
 		}
+	} else {
+		// resume sessions that were saved on the last shutdown
+		for _, app := range us.apps {
+			if suspender, ok := app.(apps.Suspender); ok {
+				suspender.Resume()
+			}
+		}
 	}
 
 	// http Client as used by the proxy
@@ -119,6 +146,8 @@ func NewUPnPServer() *UPnPServer {
 	http.HandleFunc("/upnp/description.xml", us.serveDescription)
 	http.HandleFunc("/apps/", us.serveApp)
 	http.HandleFunc("/proxy/", us.serveProxy)
+	http.HandleFunc("/api/status", us.serveStatus)
+	http.HandleFunc("/api/apps/", us.serveControl)
 	http.HandleFunc("/", us.serveHome)
 
 	return us
@@ -158,6 +187,18 @@ func (us *UPnPServer) serveHome(w http.ResponseWriter, req *http.Request) {
 		us.homeTemplate = tmpl
 	}
 
+	err := us.homeTemplate.Execute(w, map[string]interface{}{
+		"Title": us.friendlyName,
+		"Apps":  us.appStatus(),
+	})
+	if err != nil {
+		// this shouldn't happen
+		panic(err)
+	}
+}
+
+// appStatus returns the status of all apps, sorted by name.
+func (us *UPnPServer) appStatus() []apps.Status {
 	appNames := make([]string, len(us.apps))
 	i := 0
 	for name, _ := range us.apps {
@@ -166,23 +207,145 @@ func (us *UPnPServer) serveHome(w http.ResponseWriter, req *http.Request) {
 	}
 	sort.Strings(appNames)
 
-	apps := make([]struct {
-		Name    string
-		Running bool
-	}, len(us.apps))
+	status := make([]apps.Status, len(us.apps))
 	for i, name := range appNames {
-		apps[i].Name = us.apps[name].FriendlyName()
-		apps[i].Running = us.apps[name].Running()
+		status[i] = us.apps[name].Status()
 	}
+	return status
+}
 
-	err := us.homeTemplate.Execute(w, map[string]interface{}{
-		"Title": us.friendlyName,
-		"Apps":  apps,
+// serveStatus returns the status of all apps as JSON.
+func (us *UPnPServer) serveStatus(w http.ResponseWriter, req *http.Request) {
+	logger.Println(req.Method, req.URL.Path)
+
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"name": us.friendlyName,
+		"apps": us.appStatus(),
 	})
 	if err != nil {
-		// this shouldn't happen
-		panic(err)
+		logger.Warnln("could not write status:", err)
+	}
+}
+
+// serveControl sends a command to an app. Arguments are passed as form
+// values. Forms on the home page are redirected back to it.
+//
+// Approving a remote needs the code that is shown on the TV. All other
+// commands need the API password (with HTTP basic authentication, the user name
+// is ignored), and are disabled when no password has been configured.
+func (us *UPnPServer) serveControl(w http.ResponseWriter, req *http.Request) {
+	logger.Println(req.Method, req.URL.Path)
+
+	matches := us.controlMatchString.FindStringSubmatch(req.URL.Path)
+	if matches == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(req) {
+		// Another web site is trying to control an app through the
+		// browser of someone on the local network.
+		logger.Warnln("cross-origin request from", req.Header.Get("Origin"), req.Header.Get("Referer"))
+		http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+		return
+	}
+
+	if matches[2] != "approve" && !authorized(w, req) {
+		return
+	}
+
+	app, ok := us.apps[matches[1]]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	controller, ok := app.(apps.Controller)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := controller.Control(matches[2], req.PostForm)
+	if err == apps.ErrUnknownCommand {
+		http.NotFound(w, req)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if strings.Contains(req.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, req, "/", http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorized checks the API password of a request. When it is missing or
+// wrong, it writes the error response and returns false.
+func authorized(w http.ResponseWriter, req *http.Request) bool {
+	password := apiPassword()
+	if password == "" {
+		http.Error(w, "the control API is disabled, set a password with -api-password or the config key api.password", http.StatusForbidden)
+		return false
+	}
+	_, given, ok := req.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(password)) != 1 {
+		logger.Warnln("wrong API password from", req.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="kodicast", charset="UTF-8"`)
+		http.Error(w, "wrong API password", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// apiPassword returns the password of the control API, or an empty string
+// when there is none.
+func apiPassword() string {
+	if *flagAPIPassword != "" {
+		return *flagAPIPassword
+	}
+	password, err := config.Get().GetString("api.password", func() (string, error) {
+		return "", nil
+	})
+	if err != nil {
+		logger.Warnln("could not read API password:", err)
+		return ""
+	}
+	return password
+}
+
+// sameOrigin returns false when a browser sent the request from a page of
+// another site. Requests without Origin and Referer don't come from a web page
+// (for example curl), and are allowed.
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		origin = req.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
 	}
+	return u.Host == req.Host
 }
 
 func (us *UPnPServer) getApplicationURL(req *http.Request) string {
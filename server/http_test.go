@@ -0,0 +1,79 @@
+package server
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/sargo/kodicast/apps"
+)
+
+// controlApp is an app that records the commands it gets.
+type controlApp struct {
+	commands []string
+}
+
+func (a *controlApp) Start(string)         {}
+func (a *controlApp) Running() bool        { return true }
+func (a *controlApp) Quit()                {}
+func (a *controlApp) FriendlyName() string { return "Test" }
+func (a *controlApp) Status() apps.Status  { return apps.Status{Name: "Test"} }
+
+func (a *controlApp) Control(command string, args url.Values) error {
+	a.commands = append(a.commands, command)
+	return nil
+}
+
+func TestControlPassword(t *testing.T) {
+	flag.Set("no-config", "true")
+	app := &controlApp{}
+	us := &UPnPServer{
+		apps:               map[string]apps.App{"Test": app},
+		controlMatchString: regexp.MustCompile("^/api/apps/([a-zA-Z]+)/([a-zA-Z]+)$"),
+	}
+	control := func(command, password, origin string) int {
+		req := httptest.NewRequest("POST", "/api/apps/Test/"+command, strings.NewReader("id=remote"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if password != "" {
+			req.SetBasicAuth("", password)
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		us.serveControl(w, req)
+		return w.Code
+	}
+
+	// Without a password, only approving works.
+	for _, command := range []string{"deny", "key", "speed", "audio", "repeat", "shuffle"} {
+		if code := control(command, "secret", ""); code != http.StatusForbidden {
+			t.Errorf("%s without a configured password: got status %d", command, code)
+		}
+	}
+	if code := control("approve", "", ""); code != http.StatusNoContent {
+		t.Errorf("approve: got status %d", code)
+	}
+
+	flag.Set("api-password", "secret")
+	defer flag.Set("api-password", "")
+	for _, password := range []string{"", "wrong", "secre"} {
+		if code := control("deny", password, ""); code != http.StatusUnauthorized {
+			t.Errorf("password %q: got status %d", password, code)
+		}
+	}
+	if code := control("deny", "secret", ""); code != http.StatusNoContent {
+		t.Errorf("right password: got status %d", code)
+	}
+	if code := control("deny", "secret", "http://attacker.test"); code != http.StatusForbidden {
+		t.Errorf("cross-origin request: got status %d", code)
+	}
+
+	if strings.Join(app.commands, ",") != "approve,deny" {
+		t.Errorf("app got commands %v", app.commands)
+	}
+}
@@ -2,7 +2,12 @@ package server
 
 import (
 	"flag"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/sargo/kodicast/apps"
+	"github.com/sargo/kodicast/config"
 	"github.com/sargo/kodicast/log"
 	"github.com/nu7hatch/gouuid"
 )
@@ -26,6 +31,8 @@ func Serve() {
 	}
 
 	us := NewUPnPServer()
+	go us.handleSignals()
+
 	httpPort, err := us.startServing()
 	if err != nil {
 		logger.Fatal(err)
@@ -39,3 +46,21 @@ func Serve() {
 		select {}
 	}
 }
+
+// handleSignals suspends all running apps when the server is asked to shut
+// down, so they can be resumed on the next start.
+func (us *UPnPServer) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-signals
+	logger.Println("got signal", sig, "- shutting down")
+
+	for _, app := range us.apps {
+		if suspender, ok := app.(apps.Suspender); ok {
+			suspender.Suspend()
+		}
+	}
+
+	config.Get().Flush()
+	os.Exit(0)
+}
@@ -24,6 +24,10 @@ func serveSSDP(httpPort int) {
 		panic(err)
 	}
 	conn, err := net.ListenMulticastUDP("udp", nil, maddr)
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
 
 	// SSDP packets may at most be one UDP packet
 	buf := make([]byte, UDP_PACKET_SIZE)
@@ -56,8 +60,6 @@ func serveSSDP(httpPort int) {
 
 		go serveSSDPResponse(msg, raddr, httpPort)
 	}
-
-	defer conn.Close()
 }
 
 func serveSSDPResponse(msg *mail.Message, raddr *net.UDPAddr, httpPort int) {